@@ -2,6 +2,7 @@ package generator
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
@@ -10,23 +11,91 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"text/template"
 )
 
 const apiTemplate = `
-{{- range .Imports}}
+{{- define "client_api"}}
+{{- template "library" .}}
+{{- template "imports" .Imports}}
+{{- template "parts" .}}
+{{template "interfaces" .}}
+{{template "clients" .}}
+{{- end}}
+
+{{- define "interface_file"}}
+{{- template "library" .}}
+{{- template "imports" .Imports}}
+{{- template "parts" .}}
+{{template "interfaces" .}}
+{{- end}}
+
+{{- define "models_file"}}
+part of '{{.LibraryFile}}';
+{{- template "typedefs" .}}
+{{template "models" .}}
+{{- end}}
+
+{{- define "deprecated_file"}}
+{{- range .Services}}
+/// The methods of {{.FullName}} marked deprecated, by their Dart name.
+const {{.ConstPrefix}}DeprecatedMethods = <String>[
+	{{- range .Methods}}
+	{{- if .Deprecated}}
+	'{{.Name}}',
+	{{- end}}
+	{{- end}}
+];
+{{end}}
+{{- end}}
+
+{{- define "library"}}
+{{- if .Options.PartFiles}}
+library {{.LibraryName}};
+{{end}}
+{{- end}}
+
+{{- define "parts"}}
+{{- if .Options.PartFiles}}
+
+part '{{.PartFile}}';
+{{- end}}
+{{- if .Options.UseFreezed}}
+{{- if not .Options.PartFiles}}
+{{end}}
+part '{{.FreezedFile}}.freezed.dart';
+part '{{.FreezedFile}}.g.dart';
+{{- end}}
+{{- end}}
+
+{{- define "client_file"}}
+{{- template "imports" .ClientImports}}
+{{template "clients" .}}
+{{- end}}
+
+{{- define "imports"}}
+{{- range .}}
 import '{{.Path}}';
 {{- end}}
+{{- end}}
 
+{{- define "interfaces"}}
+{{- if not .Options.PartFiles}}
+{{- template "typedefs" .}}
+{{- end}}
+{{- if .HasExceptions}}
 class TwirpException implements Exception {
 	final String message;
-	
-	TwirpException(this.message);
-	
+	/// The rpc that failed, e.g. example.Haberdasher/MakeHat.
+	final String? method;
+
+	TwirpException(this.message, {this.method});
+
 	@override
 	String toString() {
-	return 'TwirpException{message: $message}';
+		return 'TwirpException{message: $message, method: $method}';
 	}
 }
 
@@ -34,411 +103,2698 @@ class TwirpJsonException extends TwirpException {
 	final String code;
 	final String msg;
 	final dynamic meta;
-	
-	TwirpJsonException(this.code, this.msg, this.meta) : super(msg);
-	
-	factory TwirpJsonException.fromJson(Map<String, dynamic> json) {
-	return TwirpJsonException(
-		json['code'] as String, json['msg'] as String, json['meta']);
-	}
-	
+
+	TwirpJsonException(this.code, this.msg, this.meta, {String? method}) : super(msg, method: method);
+
+	factory TwirpJsonException.fromJson(Map<String, dynamic> json, {String? method}) {
+		return TwirpJsonException(
+			json['code'] as String, json['msg'] as String, json['meta'], method: method);
+	}
+
+	/// The string valued entries of [meta], empty if the server sent no metadata.
+	Map<String, String> get metaStrings {
+		final value = meta;
+		if (value is! Map) {
+			return const {};
+		}
+		final result = <String, String>{};
+		value.forEach((k, v) {
+			if (v != null) {
+				result['$k'] = '$v';
+			}
+		});
+		return result;
+	}
+
+	@override
+	String toString() {
+		return 'TwirpJsonException{code: $code, msg: $msg, meta: $meta, method: $method}';
+	}
+}
+
+/// Thrown when the request could not be sent or no response was received.
+class TwirpNetworkException extends TwirpException {
+	final Object cause;
+
+	TwirpNetworkException(this.cause, {String? method}) : super('$cause', method: method);
+
+	@override
+	String toString() {
+		return 'TwirpNetworkException{cause: $cause, method: $method}';
+	}
+}
+
+/// Thrown for 4xx responses.
+class TwirpClientException extends TwirpJsonException {
+	final int statusCode;
+
+	TwirpClientException(this.statusCode, String code, String msg, dynamic meta, {String? method})
+		: super(code, msg, meta, method: method);
+
+	@override
+	String toString() {
+		return 'TwirpClientException{statusCode: $statusCode, code: $code, msg: $msg, meta: $meta, method: $method}';
+	}
+}
+
+/// Thrown for 5xx responses.
+class TwirpServerException extends TwirpJsonException {
+	final int statusCode;
+
+	TwirpServerException(this.statusCode, String code, String msg, dynamic meta, {String? method})
+		: super(code, msg, meta, method: method);
+
+	@override
+	String toString() {
+		return 'TwirpServerException{statusCode: $statusCode, code: $code, msg: $msg, meta: $meta, method: $method}';
+	}
+}
+
+/// The HTTP status of every Twirp error code, as listed in the Twirp
+/// specification.
+const Map<String, int> twirpCodeToHttpStatus = {
+	'canceled': 408,
+	'invalid_argument': 400,
+	'malformed': 400,
+	'deadline_exceeded': 408,
+	'not_found': 404,
+	'bad_route': 404,
+	'already_exists': 409,
+	'permission_denied': 403,
+	'unauthenticated': 401,
+	'resource_exhausted': 429,
+	'failed_precondition': 412,
+	'aborted': 409,
+	'out_of_range': 400,
+	'unimplemented': 501,
+	'internal': 500,
+	'unavailable': 503,
+	'dataloss': 500,
+	'unknown': 500,
+};
+{{- end}}
+{{- if .Services}}
+
+/// Typed access to the common request headers, serialized with [toMap]. Pass
+/// headerProvider: headers.toMap to a client to send them with every request:
+///
+///     final headers = TwirpHeaders()..authorization = 'Bearer $token';
+///
+/// Header names are lowercased, setting a header to null removes it.
+class TwirpHeaders {
+	final Map<String, String> _headers = {};
+
+	TwirpHeaders([Map<String, String>? headers]) {
+		headers?.forEach((name, value) => this[name] = value);
+	}
+
+	String? get authorization => this['authorization'];
+	set authorization(String? value) => this['authorization'] = value;
+
+	String? get requestId => this['x-request-id'];
+	set requestId(String? value) => this['x-request-id'] = value;
+
+	String? operator [](String name) => _headers[name.toLowerCase()];
+
+	void operator []=(String name, String? value) {
+		if (value == null) {
+			_headers.remove(name.toLowerCase());
+		} else {
+			_headers[name.toLowerCase()] = value;
+		}
+	}
+
+	Map<String, String> toMap() => Map.of(_headers);
+
+	@override
+	String toString() {
+		return 'TwirpHeaders$_headers';
+	}
+}
+
+{{- if eq .Options.ErrorStyle "result"}}
+
+/// The outcome of an rpc: either its output [value] or the [error] it failed
+/// with.
+class Result<T, E> {
+	final T? _value;
+	final E? _error;
+	final bool isOk;
+
+	const Result.ok(T value) : _value = value, _error = null, isOk = true;
+
+	const Result.err(E error) : _value = null, _error = error, isOk = false;
+
+	bool get isErr => !isOk;
+
+	/// The output of the rpc, throws a [StateError] if it failed.
+	T get value {
+		if (!isOk) {
+			throw StateError('no value in $this');
+		}
+		return _value as T;
+	}
+
+	/// The error of the rpc, throws a [StateError] if it succeeded.
+	E get error {
+		if (isOk) {
+			throw StateError('no error in $this');
+		}
+		return _error as E;
+	}
+
+	/// Calls [onOk] with the value or [onErr] with the error.
+	R fold<R>(R Function(T value) onOk, R Function(E error) onErr) {
+		return isOk ? onOk(_value as T) : onErr(_error as E);
+	}
+
+	@override
+	String toString() {
+		return isOk ? 'Result.ok($_value)' : 'Result.err($_error)';
+	}
+}
+{{- else if eq .Options.ErrorStyle "sealed"}}
+
+/// The outcome of an rpc, either [Ok] with its output or [Err] with the
+/// [TwirpException] it failed with. Switches over it are exhaustive.
+sealed class TwirpResult<T> {
+	const TwirpResult();
+}
+
+/// A successful rpc.
+final class Ok<T> extends TwirpResult<T> {
+	final T value;
+
+	const Ok(this.value);
+
+	@override
+	String toString() {
+		return 'Ok($value)';
+	}
+}
+
+/// A failed rpc.
+final class Err<T> extends TwirpResult<T> {
+	final TwirpException error;
+
+	const Err(this.error);
+
+	@override
+	String toString() {
+		return 'Err($error)';
+	}
+}
+{{- end}}
+{{- end}}
+
+{{- with .MetaModel}}
+
+/// A [TwirpJsonException] whose meta object is decoded into a [{{.Name}}],
+/// for servers sending structured error metadata.
+class TypedException extends TwirpJsonException {
+	final {{.Name}} typedMeta;
+
+	TypedException(String code, String msg, dynamic meta, {String? method})
+		: typedMeta = decodeMeta(meta),
+			super(code, msg, meta, method: method);
+
+	factory TypedException.fromJson(Map<String, dynamic> json, {String? method}) {
+		return TypedException(json['code'] as String, json['msg'] as String, json['meta'], method: method);
+	}
+
+	/// Converts an exception thrown by a client, e.g. a [TwirpClientException].
+	factory TypedException.from(TwirpJsonException e) {
+		return TypedException(e.code, e.msg, e.meta, method: e.method);
+	}
+
+	/// Decodes the proto3 JSON [meta] into a [{{.Name}}], the default message
+	/// if it is not an object. Unknown fields are ignored.
+	static {{.Name}} decodeMeta(dynamic meta) {
+		final message = {{.Name}}();
+		if (meta is Map) {
+			message.mergeFromProto3Json(meta, ignoreUnknownFields: true);
+		}
+		return message;
+	}
+
+	@override
+	String toString() {
+		return 'TypedException{code: $code, msg: $msg, meta: $typedMeta, method: $method}';
+	}
+}
+{{- end}}
+
+{{- with .ErrorEnum}}
+
+/// A [TwirpJsonException] carrying a [{{.Name}}] domain error, parsed from the
+/// error meta field or else the code of the Twirp error.
+class {{.Name}}Exception extends TwirpJsonException {
+	/// The domain error, null if neither names a value of [{{.Name}}].
+	final {{.Name}}? error;
+
+	{{.Name}}Exception(String code, String msg, dynamic meta, {String? method})
+		: error = parseError(code, meta),
+			super(code, msg, meta, method: method);
+
+	factory {{.Name}}Exception.fromJson(Map<String, dynamic> json, {String? method}) {
+		return {{.Name}}Exception(json['code'] as String, json['msg'] as String, json['meta'], method: method);
+	}
+
+	/// Converts an exception thrown by a client, e.g. a [TwirpClientException].
+	factory {{.Name}}Exception.from(TwirpJsonException e) {
+		return {{.Name}}Exception(e.code, e.msg, e.meta, method: e.method);
+	}
+
+	/// Returns the value of [{{.Name}}] named by the error field of [meta], or
+	/// by the upper case [code], e.g. NOT_FOUND for not_found.
+	static {{.Name}}? parseError(String code, dynamic meta) {
+		final names = [
+			if (meta is Map && meta['error'] is String) meta['error'] as String,
+			code.toUpperCase(),
+		];
+		for (final name in names) {
+			for (final value in {{.Name}}.values) {
+				if (value.name == name) {
+					return value;
+				}
+			}
+		}
+		return null;
+	}
+
 	@override
 	String toString() {
-	return 'TwirpJsonException{code: $code, msg: $msg, meta: $meta}';
+		return '{{.Name}}Exception{code: $code, msg: $msg, error: $error, method: $method}';
 	}
 }
+{{- end}}
+
+{{if not .Options.PartFiles}}
+{{- template "models" .}}
+{{- end}}
+
+{{- if .HasHealth}}
+
+/// The serving status reported by a health rpc.
+enum TwirpHealthStatus { serving, notServing, unknown }
+
+/// Parses a status name of the grpc.health.v1 protocol, e.g. SERVING or
+/// NOT_SERVING.
+TwirpHealthStatus parseTwirpHealthStatus(String status) {
+	switch (status.toUpperCase()) {
+		case 'SERVING':
+			return TwirpHealthStatus.serving;
+		case 'NOT_SERVING':
+			return TwirpHealthStatus.notServing;
+	}
+	return TwirpHealthStatus.unknown;
+}
+{{- end}}
 
 {{range .Services}}
 abstract class {{.Name}} {
 	{{- range .Methods}}
-	Future<{{.OutputType}}>{{.Name}}({{.InputType}} {{.InputArg}});
-    {{- end}}
+	// from {{.Origin}}
+	{{- if $.Options.DocumentErrors}}
+	{{- template "throws_doc" $}}
+	{{- end}}
+	{{- if $.Options.ReturnsResult}}
+	Future<{{$.Options.ResultType .ReturnType}}> {{.Name}}({{.InputType}} {{.InputArg}}{{template "timeout_param" .}});
+	{{- else}}
+	Future<{{.ReturnType}}> {{.Name}}({{.InputType}} {{.InputArg}}{{template "timeout_param" .}});
+	{{- end}}
+	{{- if $.Options.ResponseHeaders}}
+	Future<({{.ReturnType}} body, Map<String, String> headers)> {{.Name}}WithHeaders({{.InputType}} {{.InputArg}}{{template "timeout_param" .}});
+	{{- end}}
+	{{- end}}
+	{{- if not (.HasMethod "close")}}
+
+	/// Releases the connections held by the client.
+	void close();
+	{{- end}}
 }
+{{- if .HasPositional}}
 
-class TwirpJson{{.Name}} implements {{.Name}} {
-	final String hostname;
-	final _pathPrefix = "/twirp/{{.Package}}.{{.Name}}/";
+/// Shorthands for the methods of [{{.Name}}] whose requests only have scalar
+/// fields, taking the fields as positional arguments.
+extension {{.Name}}Positional on {{.Name}} {
+	{{- range .Methods}}
+	{{- if .PositionalFields}}
+	/// Calls [{{.Name}}] with a [{{.InputType}}] of the arguments.
+	{{if $.Options.ReturnsResult}}Future<{{$.Options.ResultType .ReturnType}}>{{else}}Future<{{.ReturnType}}>{{end}} {{.Name}}With(
+		{{- range $i, $f := .PositionalFields}}{{if $i}}, {{end}}{{.Type}} {{.Name}}{{end}}{{template "timeout_param" .}}) {
+		return {{.Name}}({{.InputType}}()
+			{{- range .PositionalFields}}..{{.Name}} = {{protoValue . .Name}}{{end}}{{template "timeout_arg" .}});
+	}
+	{{- end}}
+	{{- end}}
+}
+{{- end}}
+{{- $service := .Name}}
+{{- with .HealthMethod}}
+
+/// A typed health check of [{{$service}}].
+extension {{$service}}Health on {{$service}} {
+	/// Calls [{{.Name}}] with an empty request and parses the reported status.
+	Future<TwirpHealthStatus> checkHealth() async {
+		{{- if eq $.Options.ErrorStyle "result"}}
+		final response = (await {{.Name}}({{.InputType}}())).fold((value) => value, (error) => throw error);
+		{{- else if eq $.Options.ErrorStyle "sealed"}}
+		final response = switch (await {{.Name}}({{.InputType}}())) {
+			Ok(:final value) => value,
+			Err(:final error) => throw error,
+		};
+		{{- else}}
+		final response = await {{.Name}}({{.InputType}}());
+		{{- end}}
+		{{- if .HealthStatus}}
+		return parseTwirpHealthStatus({{.HealthStatus}});
+		{{- else}}
+		return TwirpHealthStatus.serving;
+		{{- end}}
+	}
+}
+{{- end}}
+{{end}}
+{{- end}}
 
-	TwirpJson{{.Name}}(this.hostname);
+{{- define "throws_doc"}}
+	{{- if eq .Options.ErrorStyle "result"}}
+	/// Completes with an error [Result] holding a [TwirpException] on a
+	/// transport or server error:
+	{{- else if eq .Options.ErrorStyle "sealed"}}
+	/// Completes with an [Err] holding a [TwirpException] on a transport or
+	/// server error:
+	{{- else}}
+	/// Throws a [TwirpException] on a transport or server error:
+	{{- end}}
+	/// a [TwirpNetworkException] when no response was received, a
+	/// [TwirpClientException] for 4xx and a [TwirpServerException] for 5xx
+	/// responses. Their code is one of the Twirp error codes canceled,
+	/// invalid_argument, malformed, deadline_exceeded, not_found, bad_route,
+	/// already_exists, permission_denied, unauthenticated, resource_exhausted,
+	/// failed_precondition, aborted, out_of_range, unimplemented, internal,
+	/// unavailable, dataloss or unknown, see [twirpCodeToHttpStatus].
+{{- end}}
 
-	@override
-    {{range .Methods}}
-	Future<{{.OutputType}}>{{.Name}}({{.InputType}} {{.InputArg}}_1) async {
-		var url = "${hostname}${_pathPrefix}{{.Path}}";
-		var uri = Uri.parse(url);
-		final body = jsonEncode({{.InputArg}}_1.toProto3Json());
-		final response = await post(
-				uri,
-				headers: {
-					'Content-Type': 'application/json'
-				},
-				body: body,
+{{- define "typedefs"}}
+{{- if .Options.TypePrefix}}
+{{range .Models}}
+{{- if not .Primitive}}
+typedef {{.Name}} = {{.Class}};
+{{- end}}
+{{- end}}
+{{- range .Enums}}
+typedef {{.Name}} = {{.Class}};
+{{- end}}
+{{end}}
+{{- end}}
+
+{{- define "pure_models"}}
+{{- range .Enums}}
+enum {{.Class}} {
+	{{- range $i, $v := .Values}}{{if $i}},{{end}}
+	{{.Name}}({{.Number}})
+	{{- end}};
+
+	const {{.Class}}(this.value);
+
+	final int value;
+	{{- range .Values}}
+	{{- $name := .Name}}
+	{{- range .Aliases}}
+	static const {{.}} = {{$name}};
+	{{- end}}
+	{{- end}}
+}
+{{end}}
+{{- range .Models}}
+{{- if not .Primitive}}
+class {{.Class}} {
+	{{- range .Fields}}
+	{{pureField .}};
+	{{- end}}
+
+	Map<String, dynamic> toProto3Json() => {{.Name}}ToJSON(this);
+
+	/// Merges the proto3 JSON object [json], unknown fields are always ignored.
+	void mergeFromProto3Json(dynamic json, {bool ignoreUnknownFields = true}) {
+		{{- if .Fields}}
+		final m = json as Map<String, dynamic>;
+		{{- end}}
+		{{- range .Fields}}
+		if (m['{{.JSONName}}'] != null) {
+			this.{{.Name}} = {{parse .}};
+		}
+		{{- end}}
+	}
+
+	{{.Class}} clone() => {{.Class}}()..mergeFromProto3Json(toProto3Json());
+}
+
+Map<String, dynamic> {{.Name}}ToJSON({{.Name}} m) {
+	return {
+		{{- range .Fields}}
+		{{pureToJSON .}},
+		{{- end}}
+	};
+}
+
+{{.Name}} JSONTo{{.Name}}(Map<String, dynamic> json) => {{.Name}}()..mergeFromProto3Json(json);
+{{end}}
+{{- end}}
+{{- end}}
+
+{{- define "models"}}
+{{- if .Options.Pure}}
+{{- template "pure_models" .}}
+{{- end}}
+{{- range .Models}}
+{{- if not .Primitive}}
+extension {{.Name}}Debug on {{.Name}} {
+	String toDebugString() {
+		return '{{.Name}}{
+			{{- range $i, $f := .Fields}}
+			{{- if $i}}, {{end}}
+			{{- if .IsRepeated}}{{.Name}}: {{"${"}}{{.Name}}.length} items
+			{{- else}}{{.Name}}: ${{.Name}}
+			{{- end}}
+			{{- end}}}';
+	}
+}
+{{end}}
+{{- end}}
+
+{{range .Models}}
+{{- if not .Primitive}}
+{{.Name}} new{{.Name}}({{if .Fields}}{
+	{{- range .Fields}}
+	{{- if and (or .IsMessage .IsBytes .IsEnum) (not .IsRepeated)}}
+	{{.Type}}? {{.Name}},
+	{{- else}}
+	{{.Type}} {{.Name}} = {{defaultValue .}},
+	{{- end}}
+	{{- end}}
+}{{end}}) {
+	final $message = {{.Name}}();
+	{{- range .Fields}}
+	{{- if .IsValueMap}}
+	$message.{{.Name}}.addAll({{.Name}}.map((k, v) => MapEntry(k, JSONToValue(v))));
+	{{- else if and .IsRepeated .IsValue}}
+	$message.{{.Name}}.addAll({{.Name}}.map(JSONToValue));
+	{{- else if .IsRepeated}}
+	$message.{{.Name}}.addAll({{protoValues . .Name}});
+	{{- else if .IsValue}}
+	if ({{.Name}} != null) {
+		$message.{{.Name}} = JSONToValue({{.Name}});
+	}
+	{{- else if or .IsMessage .IsBytes .IsEnum}}
+	if ({{.Name}} != null) {
+		$message.{{.Name}} = {{protoValue . .Name}};
+	}
+	{{- else}}
+	$message.{{.Name}} = {{protoValue . .Name}};
+	{{- end}}
+	{{- end}}
+	return $message;
+}
+{{end}}
+{{- end}}
+
+{{- if eq .Options.OneofStyle "sealed"}}
+{{- range $model := .Models}}
+{{- range .Oneofs}}
+{{- $oneof := .}}
+/// The {{.Name}} oneof of {{$model.Name}}, switch on it for exhaustive handling
+/// of its cases.
+sealed class {{.ClassName}} {
+	const {{.ClassName}}();
+}
+
+final class {{.ClassName}}NotSet extends {{.ClassName}} {
+	const {{.ClassName}}NotSet();
+}
+{{range .Fields}}
+final class {{$oneof.ClassName}}{{.CaseName}} extends {{$oneof.ClassName}} {
+	final {{.Type}} {{.Name}};
+
+	const {{$oneof.ClassName}}{{.CaseName}}(this.{{.Name}});
+}
+{{end}}
+extension {{.ClassName}}Oneof on {{$model.Name}} {
+	{{.ClassName}} get {{.Name}} {
+		switch (which{{.CaseName}}()) {
+			{{- range .Fields}}
+			case {{$oneof.Enum}}.{{.Name}}:
+				return {{$oneof.ClassName}}{{.CaseName}}({{if .IsValue}}ValueToJSON({{.Name}}){{else}}{{dartValue . .Name}}{{end}});
+			{{- end}}
+			case {{$oneof.Enum}}.notSet:
+				return const {{.ClassName}}NotSet();
+		}
+	}
+
+	set {{.Name}}({{.ClassName}} value) {
+		switch (value) {
+			{{- range .Fields}}
+			case {{$oneof.ClassName}}{{.CaseName}}(:final {{.Name}}):
+				this.{{.Name}} = {{if .IsValue}}JSONToValue({{.Name}}){{else}}{{protoValue . .Name}}{{end}};
+			{{- end}}
+			case {{.ClassName}}NotSet():
+				clear{{.CaseName}}();
+		}
+	}
+}
+{{end}}
+{{- end}}
+{{- end}}
+
+{{- if .Options.GenerateBuilders}}
+{{- range $model := .Models}}
+{{- if .CanMarshal}}
+class {{.Name}}Builder {
+	final _message = {{.Name}}();
+	{{range .Fields}}
+	{{- if .IsValueMap}}
+	{{$model.Name}}Builder {{.Name}}({{.Type}} value) {
+		_message.{{.Name}}.addAll(value.map((k, v) => MapEntry(k, JSONToValue(v))));
+		return this;
+	}
+	{{- else if and .IsRepeated .IsValue}}
+	{{$model.Name}}Builder {{.Name}}({{.Type}} value) {
+		_message.{{.Name}}.addAll(value.map(JSONToValue));
+		return this;
+	}
+	{{- else if .IsRepeated}}
+	{{$model.Name}}Builder {{.Name}}({{.Type}} value) {
+		_message.{{.Name}}.addAll({{protoValues . "value"}});
+		return this;
+	}
+	{{- else if .IsValue}}
+	{{$model.Name}}Builder {{.Name}}({{.Type}} value) {
+		_message.{{.Name}} = JSONToValue(value);
+		return this;
+	}
+	{{- else}}
+	{{$model.Name}}Builder {{.Name}}({{.Type}} value) {
+		_message.{{.Name}} = {{protoValue . "value"}};
+		return this;
+	}
+	{{- end}}
+	{{end}}
+	{{.Name}} build() => _message.clone();
+}
+{{end}}
+{{- end}}
+{{- end}}
+
+{{- if .Options.ValidateRequired}}
+{{- range $model := .Models}}
+{{- if and .CanMarshal .HasRequired}}
+extension {{.Name}}Validation on {{.Name}} {
+	/// Throws an [ArgumentError] if a required field isn't set.
+	void validate() {
+		{{- range .Fields}}
+		{{- if .IsRequired}}
+		if (!has{{.CaseName}}()) {
+			throw ArgumentError('{{$model.Name}}.{{.Name}} is required');
+		}
+		{{- end}}
+		{{- end}}
+	}
+}
+{{end}}
+{{- end}}
+{{- end}}
+
+{{- if .UsesValue}}
+/// Converts a JSON value (null, bool, num, String, List or Map) to a
+/// google.protobuf.Value.
+Value JSONToValue(dynamic json) {
+	return Value()..mergeFromProto3Json(json);
+}
+
+/// Converts a google.protobuf.Value to its JSON value.
+dynamic ValueToJSON(Value value) => value.toProto3Json();
+{{end}}
+{{- if .UsesAny}}
+/// Encodes a google.protobuf.Any in its proto3 JSON form, {"@type": typeUrl, ...}.
+/// The packed message type must be in [registry] to be rendered.
+Map<String, dynamic> AnyToJSON(Any value, [TypeRegistry registry = const TypeRegistry.empty()]) {
+	return value.toProto3Json(typeRegistry: registry) as Map<String, dynamic>;
+}
+
+/// Decodes the proto3 JSON form of a google.protobuf.Any.
+Any JSONToAny(Map<String, dynamic> json, [TypeRegistry registry = const TypeRegistry.empty()]) {
+	return Any()..mergeFromProto3Json(json, typeRegistry: registry);
+}
+
+/// Unpacks [any] into a new instance of the message registered in [registry]
+/// for its type URL, or returns null when the type is unknown.
+GeneratedMessage? unpackAny(Any any, TypeRegistry registry) {
+	final info = registry.lookup(any.typeUrl.substring(any.typeUrl.lastIndexOf('/') + 1));
+	final create = info?.createEmptyInstance;
+	if (create == null) {
+		return null;
+	}
+	final message = create();
+	any.unpackInto(message);
+	return message;
+}
+{{- end}}
+
+{{range $enum := .Enums}}
+const Map<String, int> {{.Name}}ByName = {
+	{{- range .Values}}
+	'{{.Name}}': {{.Number}},
+	{{- $number := .Number}}
+	{{- range .Aliases}}
+	'{{.}}': {{$number}},
+	{{- end}}
+	{{- end}}
+};
+
+const Map<int, String> {{.Name}}ByValue = {
+	{{- range .Values}}
+	{{.Number}}: '{{.Name}}',
+	{{- end}}
+};
+
+/// Decodes a proto3 JSON enum, which may be encoded by name or by number.
+{{.Name}} JSONTo{{.Name}}(dynamic value) {
+	if (value is int) {
+		value = {{.Name}}ByValue[value];
+	}
+	switch (value) {
+		{{- range .Values}}
+		case '{{.Name}}':
+		{{- range .Aliases}}
+		case '{{.}}':
+		{{- end}}
+			return {{$enum.Name}}.{{.Name}};
+		{{- end}}
+	}
+	throw ArgumentError('unknown {{.Name}} value $value');
+}
+
+String {{.Name}}ToJSON({{.Name}} value) => {{.Name}}ByValue[value.value] ?? value.name;
+{{end}}
+{{- if .Options.UseFreezed}}
+{{- template "freezed_models" .}}
+{{- end}}
+{{- end}}
+
+{{- define "freezed_models"}}
+{{- range .Models}}
+{{- if not .Primitive}}
+/// An immutable copy of [{{.Name}}] for package:freezed, made with
+/// [{{.Name}}Freezed.toFreezed].
+@freezed
+abstract class {{.Name}}Data with _${{.Name}}Data {
+	const {{.Name}}Data._();
+
+	@JsonSerializable(explicitToJson: true)
+	const factory {{.Name}}Data({{if .Freezed}}{
+		{{- range .Freezed}}
+		{{.Decl}},
+		{{- end}}
+	}{{end}}) = _{{.Name}}Data;
+
+	factory {{.Name}}Data.fromJson(Map<String, dynamic> json) => _${{.Name}}DataFromJson(json);
+
+	/// Converts the copy back to a [{{.Name}}].
+	{{.Name}} toProto() {
+		final $message = {{.Name}}();
+		{{- range .Freezed}}
+		{{.ToProto}}
+		{{- end}}
+		return $message;
+	}
+}
+
+extension {{.Name}}Freezed on {{.Name}} {
+	/// Returns an immutable copy of the message.
+	{{.Name}}Data toFreezed() {
+		return {{.Name}}Data(
+			{{- range .Freezed}}
+			{{.Name}}: {{.ToFreezed}},
+			{{- end}}
 		);
-		if (response.statusCode != 200) {
-			throw twirpException(response);
+	}
+}
+{{end}}
+{{- end}}
+{{- range .FreezedEnums}}
+/// Encodes {{.}} values by name in the JSON of the freezed models.
+class _{{.}}Converter implements JsonConverter<{{.}}, String> {
+	const _{{.}}Converter();
+
+	@override
+	{{.}} fromJson(String json) => {{.}}.values.firstWhere((e) => e.name == json);
+
+	@override
+	String toJson({{.}} value) => value.name;
+}
+{{end}}
+{{- if .FreezedBytes}}
+/// Encodes bytes as base64 in the JSON of the freezed models.
+class _TwirpBytesConverter implements JsonConverter<List<int>, String> {
+	const _TwirpBytesConverter();
+
+	@override
+	List<int> fromJson(String json) => base64Decode(json);
+
+	@override
+	String toJson(List<int> value) => base64Encode(value);
+}
+{{end}}
+{{- end}}
+
+{{- define "hostname_param"}}
+{{- if .Options.DefaultHostname}}{String hostname = '{{.Options.DefaultHostname}}', {{else}}String hostname, {{"{"}}{{end}}
+{{- end}}
+
+{{- define "constructor_hostname_param"}}
+{{- if .Options.DefaultHostname}}{
+		String hostname = '{{.Options.DefaultHostname}}',{{else}}String hostname, {{"{"}}{{end}}
+{{- end}}
+
+{{- define "method_signature"}}
+{{- with .Method}}
+	// from {{.Origin}}
+	@override
+	{{- if $.Options.ReturnsResult}}
+	Future<{{$.Options.ResultType .ReturnType}}> {{.Name}}({{.InputType}} {{.InputArg}}{{template "timeout_param" .}}) async {
+		try {
+			return {{if eq $.Options.ErrorStyle "sealed"}}Ok{{else}}Result.ok{{end}}(await _{{.Name}}({{.InputArg}}{{template "timeout_arg" .}}));
+		} on TwirpException catch (e) {
+			return {{if eq $.Options.ErrorStyle "sealed"}}Err{{else}}Result.err{{end}}(e);
 		}
+	}
+
+	Future<{{.ReturnType}}> _{{.Name}}({{.InputType}} {{.InputArg}}{{template "timeout_param" .}}) async {
+	{{- else if $.Options.ResponseHeaders}}
+	Future<{{.ReturnType}}> {{.Name}}({{.InputType}} {{.InputArg}}{{template "timeout_param" .}}) async {
+		final (body, _) = await {{.Name}}WithHeaders({{.InputArg}}{{template "timeout_arg" .}});
+		return body;
+	}
+
+	/// Like [{{.Name}}], also returning the response headers.
+	@override
+	Future<({{.ReturnType}} body, Map<String, String> headers)> {{.Name}}WithHeaders({{.InputType}} {{.InputArg}}{{template "timeout_param" .}}) async {
+	{{- else}}
+	Future<{{.ReturnType}}> {{.Name}}({{.InputType}} {{.InputArg}}{{template "timeout_param" .}}) async {
+	{{- end}}
+	{{- if and .Validate $.Options.ReturnsResult}}
+		// a missing required field is returned like a server side invalid_argument
+		try {
+			{{.InputArg}}.validate();
+		} on ArgumentError catch (e) {
+			throw TwirpJsonException('invalid_argument', '${e.message}', null, method: '{{.Route}}');
+		}
+	{{- else if .Validate}}
+		{{.InputArg}}.validate();
+	{{- end}}
+{{- end}}
+{{- end}}
+
+{{- define "list_output"}}
+{{- with .Method}}
+		// the response is a JSON array of {{.OutputType}}, empty when there is no body
+		final tmp = <{{.OutputType}}>[
+			if (response.body.trim().isNotEmpty)
+				for (final item in {{$.Decode}}(response.body) as List)
+					{{.OutputType}}()..mergeFromProto3Json(item{{if not $.Options.Pure}}, {{template "type_registry_arg" $.Options}}{{end}}),
+		];
+{{- end}}
+{{- end}}
+
+{{- define "method_paths"}}
+	/// The request path of every method, by its Dart name.
+	static const methodPaths = <String, String>{
+		{{- range .Methods}}
+		'{{.Name}}': '{{$.PathPrefix}}{{.Path}}',
+		{{- end}}
+	};
+	{{- range .Methods}}
+	{{- if not ($.HasMethod (print .Name "Path"))}}
+
+	/// The request path of [{{.Name}}], e.g. to route or monitor its calls.
+	static const {{.Name}}Path = '{{$.PathPrefix}}{{.Path}}';
+	{{- end}}
+	{{- end}}
+{{- end}}
+
+{{- define "last_request_id"}}
+{{- if .Options.LastRequestID}}
+		lastRequestId = response.headers['request-id'];
+{{- end}}
+{{- end}}
+
+{{- define "type_registry_arg"}}
+{{- if not .Pure}}typeRegistry: typeRegistry{{end}}
+{{- end}}
+
+{{- define "timeout_param"}}
+{{- if .DefaultTimeout}}, {Duration? timeout}{{end}}
+{{- end}}
+
+{{- define "timeout_arg"}}
+{{- if .DefaultTimeout}}, timeout: timeout{{end}}
+{{- end}}
+
+{{- define "timeout_call"}}
+{{- if .DefaultTimeout}}.timeout(timeout ?? const Duration(milliseconds: {{.DefaultTimeout}})){{end}}
+{{- end}}
+
+{{- define "timeout_catch"}}
+{{- if .DefaultTimeout}} on TimeoutException catch (e) {
+				// the timeout bounds every attempt, timed out requests are not retried
+				throw TwirpNetworkException(e, method: '{{.Route}}');
+			}
+{{- end}}
+{{- end}}
+
+{{- define "json_output"}}
+{{- with .Method}}
 		final tmp = {{.OutputType}}();
-		tmp.mergeFromProto3Json(jsonDecode(response.body));
-		return tmp;
+		// an empty body is the default output message
+		if (response.body.trim().isNotEmpty) {
+			tmp.mergeFromProto3Json({{$.Decode}}(response.body){{if not $.Options.Pure}}, {{template "type_registry_arg" $.Options}}{{end}});
+		}
+{{- end}}
+{{- end}}
+
+{{- define "hostname_arg"}}
+{{- if .Options.DefaultHostname}}hostname: hostname{{else}}hostname{{end}}
+{{- end}}
+
+{{- define "clients"}}
+{{- if .Services}}
+enum TwirpFormat { json, protobuf }
+
+/// Strips trailing slashes from [hostname] and checks that it is an absolute
+/// http or https URL, throwing an [ArgumentError] otherwise. A path is kept,
+/// https://api.example.com/gateway/ sends requests to
+/// https://api.example.com/gateway/twirp/... without a double slash.
+String normalizeTwirpHostname(String hostname) {
+	final uri = Uri.tryParse(hostname);
+	if (uri == null || (uri.scheme != 'http' && uri.scheme != 'https') || uri.host.isEmpty) {
+		throw ArgumentError.value(hostname, 'hostname', 'must be an absolute http or https URL');
+	}
+	var normalized = hostname;
+	while (normalized.endsWith('/')) {
+		normalized = normalized.substring(0, normalized.length - 1);
 	}
-    {{end}}
+	return normalized;
+}
 
-	Exception twirpException(Response response) {
-    	try {
-      		var value = jsonDecode(response.body);
-      		return TwirpJsonException.fromJson(value);
-    	} catch (e) {
-      		return TwirpException(response.body);
-    	}
-  	}
+/// Returns the URL of [path] below the Twirp mount point [base], e.g.
+/// https://api.example.com/gateway. A path prefix of [base] is kept whether
+/// or not it ends with a slash, its query and fragment are dropped.
+Uri resolveTwirpUri(Uri base, String path) {
+	final mount = Uri(
+		scheme: base.scheme,
+		userInfo: base.userInfo,
+		host: base.host,
+		port: base.hasPort ? base.port : null,
+		path: base.path.endsWith('/') ? base.path : '${base.path}/',
+	);
+	return mount.resolve(path.startsWith('/') ? path.substring(1) : path);
 }
 
-class TwirpProtobuf{{.Name}} implements {{.Name}} {
-	final String hostname;
-	final _pathPrefix = "/twirp/{{.Package}}.{{.Name}}/";
+/// Sends the requests of [_inner] without following redirects.
+class _TwirpNoRedirectClient extends BaseClient {
+	final Client _inner;
 
-	TwirpProtobuf{{.Name}}(this.hostname);
+	_TwirpNoRedirectClient(this._inner);
 
 	@override
-    {{range .Methods}}
-	Future<{{.OutputType}}>{{.Name}}({{.InputType}} {{.InputArg}}_1) async {
+	Future<StreamedResponse> send(BaseRequest request) {
+		request.followRedirects = false;
+		return _inner.send(request);
+	}
+
+	@override
+	void close() {
+		_inner.close();
+	}
+}
+{{if .Options.ContentTypeDispatch}}
+/// Decodes the body of [response] into [message] by its Content-Type, so a
+/// gateway answering in the other format is still understood. [json] picks
+/// the format when the Content-Type is neither, JSON is decoded with [codec]
+/// and the Any fields in it with [typeRegistry].
+T decodeTwirpResponse<T extends GeneratedMessage>(Response response, T message, {required bool json, JsonCodec codec = const JsonCodec(), TypeRegistry typeRegistry = const TypeRegistry.empty()}) {
+	final contentType = response.headers['content-type'] ?? '';
+	if (contentType.startsWith('{{.Options.ProtoContentType}}')) {
+		json = false;
+	} else if (contentType.startsWith('{{.Options.JSONContentType}}')) {
+		json = true;
+	}
+	if (!json) {
+		return message..mergeFromBuffer(response.bodyBytes);
+	}
+	// an empty body is the default output message
+	if (response.body.trim().isNotEmpty) {
+		message.mergeFromProto3Json(codec.decode(response.body), typeRegistry: typeRegistry);
+	}
+	return message;
+}
+{{end}}
+/// Returns the Twirp error code for an HTTP status without a Twirp JSON
+/// body, e.g. from a proxy or a non-Twirp server in front of the service.
+/// The mapping is the one the Twirp spec gives for errors from intermediaries.
+String twirpCodeForStatus(int status) {
+	if (status >= 300 && status < 400) {
+		// redirects are not followed by Twirp clients
+		return 'internal';
+	}
+	switch (status) {
+		case 400:
+			return 'internal';
+		case 401:
+			return 'unauthenticated';
+		case 403:
+			return 'permission_denied';
+		case 404:
+			return 'bad_route';
+		case 429:
+		case 502:
+		case 503:
+		case 504:
+			return 'unavailable';
+		default:
+			return 'unknown';
+	}
+}
+
+{{range .Services}}
+/// The connection settings, request path and error decoding shared by the
+/// {{.Name}} clients.
+abstract class _Twirp{{.Name}}Base {
+	final String hostname;
+	final Client client;
+	final String? userAgent;
+	final Exception Function(Response)? errorDecoder;
+	final Map<String, String> Function()? headerProvider;
+	final int maxRetries;
+	final bool followRedirects;
+	{{- if not $.Options.Pure}}
+	/// Resolves the message types packed in google.protobuf.Any fields when
+	/// they are encoded to or decoded from JSON.
+	final TypeRegistry typeRegistry;
+	{{- end}}
+	final _pathPrefix = "{{.PathPrefix}}";
+	{{- if $.Options.LastRequestID}}
+
+	/// The request-id header of the last response, null if the server sent
+	/// none.
+	String? lastRequestId;
+	{{- end}}
+
+	_Twirp{{.Name}}Base(String hostname, {
+		Client? client,
+		this.userAgent,
+		this.errorDecoder,
+		this.headerProvider,
+		this.maxRetries = 0,
+		this.followRedirects = true,
+		{{- if not $.Options.Pure}}
+		this.typeRegistry = const TypeRegistry.empty(),
+		{{- end}}
+	}) : hostname = normalizeTwirpHostname(hostname),
+		client = followRedirects ? (client ?? Client()) : _TwirpNoRedirectClient(client ?? Client());
+
+	String? _bearerToken;
+
+	/// Sends Authorization: Bearer [token] with every request, or no
+	/// Authorization header when [token] is null. A headerProvider returning
+	/// an Authorization header overrides it.
+	void setBearerToken(String? token) {
+		_bearerToken = token;
+	}
+
+	{{- if not (.HasMethod "close")}}
+
+	/// Closes the underlying [client]. Reuse a single client for many calls so
+	/// connections are kept alive, and close it once it is no longer needed.
+	void close() {
+		client.close();
+	}
+	{{- end}}
+	{{- if $.Options.Reflection}}
+
+	Uint8List? _serviceDescriptor;
+
+	/// Posts to the descriptor endpoint {{.PathPrefix}}_descriptor and returns
+	/// the raw bytes of the service descriptor it responds with, e.g. to check
+	/// the compatibility of the server at runtime. The bytes are cached, pass
+	/// [refresh] to fetch them again.
+	Future<Uint8List> fetchServiceDescriptor({bool refresh = false}) async {
+		final cached = _serviceDescriptor;
+		if (cached != null && !refresh) {
+			return cached;
+		}
+		final response = await client.post(Uri.parse("${hostname}${_pathPrefix}_descriptor"), headers: {
+			if (userAgent != null) 'User-Agent': userAgent!,
+			if (_bearerToken != null) 'Authorization': 'Bearer $_bearerToken',
+			...?headerProvider?.call(),
+		});
+		if (response.statusCode != 200) {
+			throw twirpException(response, method: '{{.FullName}}/_descriptor');
+		}
+		return _serviceDescriptor = response.bodyBytes;
+	}
+	{{- end}}
+	{{- range .Methods}}
+	{{- if .QueryFields}}
+	{{- $arg := .InputArg}}
+
+	/// Returns the scalar fields of [{{.InputArg}}] as a query string, e.g.
+	/// {{range $i, $f := .QueryFields}}{{if $i}}&{{end}}{{.JSONName}}=...{{end}}.
+	String {{.Name}}Query({{.InputType}} {{.InputArg}}) {
+		return Uri(queryParameters: {
+			{{- range .QueryFields}}
+			'{{.JSONName}}': {{queryValue $arg .}},
+			{{- end}}
+		}).query;
+	}
+	{{- end}}
+	{{- end}}
+
+	Exception twirpException(Response response, {String? method}) {
+		final decoder = errorDecoder;
+		if (decoder != null) {
+			return decoder(response);
+		}
+		TwirpJsonException? error;
+		try {
+			error = TwirpJsonException.fromJson(jsonDecode(response.body), method: method);
+		} catch (e) {
+			error = null;
+		}
+		final status = response.statusCode;
+		if (error == null && status >= 300 && status < 400) {
+			final location = response.headers['location'];
+			return TwirpJsonException(
+				twirpCodeForStatus(status),
+				'unexpected HTTP status code $status received, Location=$location',
+				_intermediaryMeta(response)..['location'] = location ?? '',
+				method: method);
+		}
+		if (status >= 400 && status < 600) {
+			final code = error?.code ?? twirpCodeForStatus(status);
+			final msg = error?.msg ?? response.body;
+			final meta = error != null ? error.meta : _intermediaryMeta(response);
+			if (status >= 500) {
+				return TwirpServerException(status, code, msg, meta, method: method);
+			}
+			return TwirpClientException(status, code, msg, meta, method: method);
+		}
+		return error ?? TwirpException(response.body, method: method);
+	}
+
+	/// The meta of an error without a Twirp JSON body, as in the Twirp spec.
+	Map<String, String> _intermediaryMeta(Response response) {
+		return {
+			'http_error_from_intermediary': 'true',
+			'status_code': '${response.statusCode}',
+			'body': response.body,
+		};
+	}
+}
+{{if $.Options.JSONClient}}
+class {{$.Options.JSONClientPrefix}}{{.Name}} extends _Twirp{{.Name}}Base implements {{.Name}} {
+	final bool prettyPrint;
+	final JsonCodec codec;
+{{template "method_paths" .}}
+
+	/// Requests are sent with [client], a new [Client] by default. For mutual
+	/// TLS pass an IOClient from package:http/io_client.dart wrapping an
+	/// HttpClient that presents the client certificate:
+	///
+	///     final context = SecurityContext()
+	///       ..useCertificateChain('client.crt')
+	///       ..usePrivateKey('client.key');
+	///     final client = IOClient(HttpClient(context: context));
+	///
+	/// [headerProvider] is called for every request and its headers are added
+	/// to it, e.g. to propagate the W3C traceparent of the current span.
+	///
+	/// A request failing with a connection error is sent again up to
+	/// [maxRetries] times. 5xx responses are only retried for methods marked
+	/// idempotent with the idempotency_level option.
+	///
+	/// With [followRedirects] false a redirect fails the call instead of being
+	/// followed, e.g. to notice a misconfigured hostname.
+	///
+	/// The JSON of requests and responses is encoded and decoded with [codec],
+	/// e.g. a JsonCodec subclass delegating to a faster JSON library.
+	{{$.Options.JSONClientPrefix}}{{.Name}}({{template "constructor_hostname_param" $}}
+		super.client,
+		super.userAgent = '{{$.UserAgent}}',
+		this.prettyPrint = false,
+		this.codec = json,
+		super.errorDecoder,
+		super.headerProvider,
+		super.maxRetries,
+		super.followRedirects,
+		{{- if not $.Options.Pure}}
+		super.typeRegistry,
+		{{- end}}
+	}) : super(hostname);
+{{- range .Methods}}
+{{template "method_signature" dict "Method" . "Options" $.Options}}
 		var url = "${hostname}${_pathPrefix}{{.Path}}";
 		var uri = Uri.parse(url);
-		final body = {{.InputArg}}_1.writeToBuffer();
-		final response = await post(
-				uri,
-				headers: {
-					'Content-Type': 'application/protobuf'
-				},
-				body: body,
-		);
+		{{- if .UsesJSON true}}
+		final body = encodeJson({{.InputArg}}.toProto3Json({{template "type_registry_arg" $.Options}}));
+		{{- else}}
+		// the (twirp_dart.encoding) option forces protobuf
+		final body = {{.InputArg}}.writeToBuffer();
+		{{- end}}
+		final headers = {
+			'Content-Type': '{{if .UsesJSON true}}{{$.Options.JSONContentType}}{{else}}{{$.Options.ProtoContentType}}{{end}}',
+			if (userAgent != null) 'User-Agent': userAgent!,
+			if (_bearerToken != null) 'Authorization': 'Bearer $_bearerToken',
+			...?headerProvider?.call(),
+		};
+		Response response;
+		for (var attempt = 0; ; attempt++) {
+			try {
+				{{- if and $.Options.GetRequests .NoSideEffects (.UsesJSON true)}}
+				// Twirp v5 GET protocol: the JSON request is sent base64 encoded in the req query parameter.
+				response = await client.get(
+					uri.replace(queryParameters: {'req': base64Encode(utf8.encode(body))}),
+					headers: headers,
+				){{template "timeout_call" .}};
+				{{- else}}
+				response = await client.post(
+					uri,
+					headers: headers,
+					body: body,
+				){{template "timeout_call" .}};
+				{{- end}}
+			} on ClientException catch (e) {
+				if (attempt < maxRetries) {
+					continue;
+				}
+				throw TwirpNetworkException(e, method: '{{.Route}}');
+			}
+			{{- template "timeout_catch" .}}
+			{{- if .Idempotent}}
+			if (response.statusCode >= 500 && attempt < maxRetries) {
+				continue;
+			}
+			{{- end}}
+			break;
+		}
+		{{- template "last_request_id" $}}
 		if (response.statusCode != 200) {
-			throw twirpException(response);
+			throw twirpException(response, method: '{{.Route}}');
+		}
+		{{- if .ListOutput}}
+		{{- template "list_output" dict "Method" . "Decode" "codec.decode" "Options" $.Options}}
+		{{- else if $.Options.ContentTypeDispatch}}
+		final tmp = decodeTwirpResponse(response, {{.OutputType}}(), json: {{.UsesJSON true}}, codec: codec, typeRegistry: typeRegistry);
+		{{- else if .UsesJSON true}}
+		{{- template "json_output" dict "Method" . "Decode" "codec.decode" "Options" $.Options}}
+		{{- else}}
+		final tmp = {{.OutputType}}.fromBuffer(response.bodyBytes);
+		{{- end}}
+		{{- if $.Options.ResponseHeaders}}
+		return (tmp, response.headers);
+		{{- else}}
+		return tmp;
+		{{- end}}
+	}
+{{- end}}
+	{{- if $.Options.Batch}}
+	{{- $service := .}}
+	{{- range .Methods}}
+	{{- if and (not .ListOutput) (.UsesJSON true) (not ($service.HasMethod (print .Name "Batch")))}}
+
+	/// Calls [{{.Name}}] with all of [requests] in one request to the batch
+	/// endpoint of the gateway, {{$service.PathPrefix}}{{.Path}}/batch, which
+	/// takes a JSON array of requests and responds with the array of their
+	/// outputs. Only connection errors are retried.
+	{{- if $.Options.ReturnsResult}}
+	Future<{{$.Options.ResultType (print "List<" .OutputType ">")}}> {{.Name}}Batch(List<{{.InputType}}> requests{{template "timeout_param" .}}) async {
+		try {
+			return {{if eq $.Options.ErrorStyle "sealed"}}Ok{{else}}Result.ok{{end}}(await _{{.Name}}Batch(requests{{template "timeout_arg" .}}));
+		} on TwirpException catch (e) {
+			return {{if eq $.Options.ErrorStyle "sealed"}}Err{{else}}Result.err{{end}}(e);
 		}
+	}
+
+	Future<List<{{.OutputType}}>> _{{.Name}}Batch(List<{{.InputType}}> requests{{template "timeout_param" .}}) async {
+		{{- if .Validate}}
+		// a missing required field is returned like a server side invalid_argument
+		try {
+			for (final request in requests) {
+				request.validate();
+			}
+		} on ArgumentError catch (e) {
+			throw TwirpJsonException('invalid_argument', '${e.message}', null, method: '{{.Route}}/batch');
+		}
+		{{- end}}
+	{{- else}}
+	Future<List<{{.OutputType}}>> {{.Name}}Batch(List<{{.InputType}}> requests{{template "timeout_param" .}}) async {
+		{{- if .Validate}}
+		for (final request in requests) {
+			request.validate();
+		}
+		{{- end}}
+	{{- end}}
+		var uri = Uri.parse("${hostname}${_pathPrefix}{{.Path}}/batch");
+		final body = encodeJson([for (final request in requests) request.toProto3Json({{template "type_registry_arg" $.Options}})]);
+		final headers = {
+			'Content-Type': '{{$.Options.JSONContentType}}',
+			if (userAgent != null) 'User-Agent': userAgent!,
+			if (_bearerToken != null) 'Authorization': 'Bearer $_bearerToken',
+			...?headerProvider?.call(),
+		};
+		Response response;
+		for (var attempt = 0; ; attempt++) {
+			try {
+				response = await client.post(
+					uri,
+					headers: headers,
+					body: body,
+				){{template "timeout_call" .}};
+			} on ClientException catch (e) {
+				if (attempt < maxRetries) {
+					continue;
+				}
+				throw TwirpNetworkException(e, method: '{{.Route}}/batch');
+			}
+			{{- if .DefaultTimeout}} on TimeoutException catch (e) {
+				// the timeout bounds every attempt, timed out requests are not retried
+				throw TwirpNetworkException(e, method: '{{.Route}}/batch');
+			}
+			{{- end}}
+			break;
+		}
+		{{- template "last_request_id" $}}
+		if (response.statusCode != 200) {
+			throw twirpException(response, method: '{{.Route}}/batch');
+		}
+		{{- template "list_output" dict "Method" . "Decode" "codec.decode" "Options" $.Options}}
+		return tmp;
+	}
+	{{- end}}
+	{{- end}}
+	{{- end}}
+	{{- if not (.HasMethod "invoke")}}
+
+	/// Calls the rpc named [method] with the proto3 JSON [jsonRequest] and
+	/// returns the decoded JSON response, for tooling that doesn't know the
+	/// message types. Only connection errors are retried.
+	Future<dynamic> invoke(String method, dynamic jsonRequest) async {
+		var url = "${hostname}${_pathPrefix}${method}";
+		var uri = Uri.parse(url);
+		final body = encodeJson(jsonRequest);
+		final headers = {
+			'Content-Type': '{{$.Options.JSONContentType}}',
+			if (userAgent != null) 'User-Agent': userAgent!,
+			if (_bearerToken != null) 'Authorization': 'Bearer $_bearerToken',
+			...?headerProvider?.call(),
+		};
+		Response response;
+		for (var attempt = 0; ; attempt++) {
+			try {
+				response = await client.post(
+					uri,
+					headers: headers,
+					body: body,
+				);
+			} on ClientException catch (e) {
+				if (attempt < maxRetries) {
+					continue;
+				}
+				throw TwirpNetworkException(e, method: '{{.FullName}}/$method');
+			}
+			break;
+		}
+		{{- template "last_request_id" $}}
+		if (response.statusCode != 200) {
+			throw twirpException(response, method: '{{.FullName}}/$method');
+		}
+		if (response.body.trim().isEmpty) {
+			return <String, dynamic>{};
+		}
+		return codec.decode(response.body);
+	}
+	{{- end}}
+
+	String encodeJson(Object? value) {
+		if (prettyPrint) {
+			// JsonCodec doesn't expose its toEncodable, so the JSON encoded by
+			// the codec is indented instead of the value itself
+			return JsonEncoder.withIndent('  ').convert(jsonDecode(codec.encode(value)));
+		}
+		return codec.encode(value);
+	}
+}
+{{end}}
+{{- if $.Options.ProtoClient}}
+class {{$.Options.ProtoClientPrefix}}{{.Name}} extends _Twirp{{.Name}}Base implements {{.Name}} {
+{{- template "method_paths" .}}
+
+	/// Requests are sent with [client], a new [Client] by default. For mutual
+	/// TLS pass an IOClient from package:http/io_client.dart wrapping an
+	/// HttpClient that presents the client certificate:
+	///
+	///     final context = SecurityContext()
+	///       ..useCertificateChain('client.crt')
+	///       ..usePrivateKey('client.key');
+	///     final client = IOClient(HttpClient(context: context));
+	///
+	/// [headerProvider] is called for every request and its headers are added
+	/// to it, e.g. to propagate the W3C traceparent of the current span.
+	///
+	/// A request failing with a connection error is sent again up to
+	/// [maxRetries] times. 5xx responses are only retried for methods marked
+	/// idempotent with the idempotency_level option.
+	///
+	/// With [followRedirects] false a redirect fails the call instead of being
+	/// followed, e.g. to notice a misconfigured hostname.
+	{{$.Options.ProtoClientPrefix}}{{.Name}}({{template "constructor_hostname_param" $}}
+		super.client,
+		super.userAgent = '{{$.UserAgent}}',
+		super.errorDecoder,
+		super.headerProvider,
+		super.maxRetries,
+		super.followRedirects,
+		{{- if not $.Options.Pure}}
+		super.typeRegistry,
+		{{- end}}
+	}) : super(hostname);
+{{- range .Methods}}
+{{template "method_signature" dict "Method" . "Options" $.Options}}
+		var url = "${hostname}${_pathPrefix}{{.Path}}";
+		var uri = Uri.parse(url);
+		{{- if .ListOutput}}
+		// a list of messages has no protobuf encoding, list rpcs use JSON
+		final body = jsonEncode({{.InputArg}}.toProto3Json(typeRegistry: typeRegistry));
+		{{- else if .UsesJSON false}}
+		// the (twirp_dart.encoding) option forces JSON
+		final body = jsonEncode({{.InputArg}}.toProto3Json(typeRegistry: typeRegistry));
+		{{- else}}
+		final body = {{.InputArg}}.writeToBuffer();
+		{{- end}}
+		final headers = {
+			'Content-Type': '{{if .UsesJSON false}}{{$.Options.JSONContentType}}{{else}}{{$.Options.ProtoContentType}}{{end}}',
+			if (userAgent != null) 'User-Agent': userAgent!,
+			if (_bearerToken != null) 'Authorization': 'Bearer $_bearerToken',
+			...?headerProvider?.call(),
+		};
+		Response response;
+		for (var attempt = 0; ; attempt++) {
+			try {
+				response = await client.post(
+					uri,
+					headers: headers,
+					body: body,
+				){{template "timeout_call" .}};
+			} on ClientException catch (e) {
+				if (attempt < maxRetries) {
+					continue;
+				}
+				throw TwirpNetworkException(e, method: '{{.Route}}');
+			}
+			{{- template "timeout_catch" .}}
+			{{- if .Idempotent}}
+			if (response.statusCode >= 500 && attempt < maxRetries) {
+				continue;
+			}
+			{{- end}}
+			break;
+		}
+		{{- template "last_request_id" $}}
+		if (response.statusCode != 200) {
+			throw twirpException(response, method: '{{.Route}}');
+		}
+		{{- if or $.Options.ContentTypeDispatch (.UsesJSON false)}}
+		{{- if .ListOutput}}
+		{{- template "list_output" dict "Method" . "Decode" "jsonDecode" "Options" $.Options}}
+		{{- else if $.Options.ContentTypeDispatch}}
+		final tmp = decodeTwirpResponse(response, {{.OutputType}}(), json: {{.UsesJSON false}}, typeRegistry: typeRegistry);
+		{{- else}}
+		{{- template "json_output" dict "Method" . "Decode" "jsonDecode" "Options" $.Options}}
+		{{- end}}
+		{{- if $.Options.ResponseHeaders}}
+		return (tmp, response.headers);
+		{{- else}}
+		return tmp;
+		{{- end}}
+		{{- else if $.Options.ResponseHeaders}}
+		return ({{.OutputType}}.fromBuffer(response.bodyBytes), response.headers);
+		{{- else}}
 		return {{.OutputType}}.fromBuffer(response.bodyBytes);
+		{{- end}}
 	}
-    {{end}}
+{{- end}}
+}
+{{end}}
+/// Creates a {{.Name}} client{{if and $.Options.JSONClient $.Options.ProtoClient}} speaking [format]{{end}}. The generated code only
+/// depends on the platform-agnostic [Client] interface of package:http, pass
+/// [client] to pick the implementation of the platform, e.g. with a
+/// conditional import:
+///
+///     // http_client.dart
+///     export 'http_client_io.dart'
+///         if (dart.library.js_interop) 'http_client_web.dart';
+///
+///     // http_client_io.dart
+///     Client createHttpClient() => IOClient(HttpClient());
+///
+///     // http_client_web.dart
+///     Client createHttpClient() => BrowserClient()..withCredentials = true;
+///
+///     final service = create{{.Name}}(hostname, client: createHttpClient());
+///
+/// Without [client] the default [Client] of package:http is used.
+{{- if not $.Options.ProtoClient}}
+{{.Name}} create{{.Name}}({{template "hostname_param" $}}Client? client}) {
+	return {{$.Options.JSONClientPrefix}}{{.Name}}({{template "hostname_arg" $}}, client: client);
+}
+{{- else if not $.Options.JSONClient}}
+{{.Name}} create{{.Name}}({{template "hostname_param" $}}Client? client}) {
+	return {{$.Options.ProtoClientPrefix}}{{.Name}}({{template "hostname_arg" $}}, client: client);
+}
+{{- else}}
+{{.Name}} create{{.Name}}({{template "hostname_param" $}}TwirpFormat format = TwirpFormat.protobuf, Client? client}) {
+	if (format == TwirpFormat.json) {
+		return {{$.Options.JSONClientPrefix}}{{.Name}}({{template "hostname_arg" $}}, client: client);
+	}
+	return {{$.Options.ProtoClientPrefix}}{{.Name}}({{template "hostname_arg" $}}, client: client);
+}
+{{- end}}
 
-	Exception twirpException(Response response) {
-    	try {
-      		var value = jsonDecode(response.body);
-      		return TwirpJsonException.fromJson(value);
-    	} catch (e) {
-      		return TwirpException(response.body);
-    	}
-  	}
+/// Like [create{{.Name}}] for the service mounted at [base], resolving the
+/// request paths against it with [resolveTwirpUri].
+{{.Name}} create{{.Name}}FromUri(Uri base, {{"{"}}{{if and $.Options.JSONClient $.Options.ProtoClient}}TwirpFormat format = TwirpFormat.protobuf, {{end}}Client? client}) {
+	return create{{.Name}}({{if $.Options.DefaultHostname}}hostname: {{end}}resolveTwirpUri(base, '').toString(), {{if and $.Options.JSONClient $.Options.ProtoClient}}format: format, {{end}}client: client);
 }
 
 {{end}}
+{{- end}}
+{{- end}}
 `
 
+// Oneof is a oneof of a model, generated as a sealed class hierarchy with
+// oneof_style=sealed.
+type Oneof struct {
+	// Name is the Dart name of the oneof, CaseName its capitalized form
+	// used by the which<Oneof>() and clear<Oneof>() methods of protoc-gen-dart.
+	Name     string
+	CaseName string
+	// ClassName is the sealed base class, Enum the protoc-gen-dart enum of
+	// the set field.
+	ClassName string
+	Enum      string
+	Fields    []ModelField
+}
+
 type Model struct {
+	// Name is the Dart name of the model, Class the protoc-gen-dart class it
+	// aliases when the type_prefix option is set.
 	Name         string
+	Class        string
 	Primitive    bool
 	Fields       []ModelField
+	Oneofs       []*Oneof
 	CanMarshal   bool
 	CanUnmarshal bool
+	// Freezed are the fields of the @freezed copy with use_freezed.
+	Freezed []FreezedField
+}
+
+// FreezedField is a field of the @freezed copy of a model.
+type FreezedField struct {
+	Name string
+	// Decl declares the field in the factory constructor of the copy.
+	Decl string
+	// ToFreezed reads the field from the message, ToProto sets it on the
+	// message m from the copy.
+	ToFreezed string
+	ToProto   string
+}
+
+// IsValueMap reports whether f is a map with google.protobuf.Value values.
+func (f ModelField) IsValueMap() bool {
+	return f.IsMap && f.MapValueField.IsValue
+}
+
+// HasRequired reports whether the model has proto2 required fields.
+func (m *Model) HasRequired() bool {
+	for _, f := range m.Fields {
+		if f.IsRequired {
+			return true
+		}
+	}
+	return false
 }
 
 type ModelField struct {
-	Name          string
-	Type          string
-	InternalType  string
-	JSONName      string
-	JSONType      string
-	IsMessage     bool
-	IsRepeated    bool
+	Name         string
+	Type         string
+	InternalType string
+	JSONName     string
+	JSONType     string
+	IsMessage    bool
+	IsBytes      bool
+	IsFieldMask  bool
+	// IsValue is set for google.protobuf.Value fields, typed dynamic.
+	IsValue bool
+	// IsJSString is set for 64-bit integers with jstype = JS_STRING, whose
+	// JSON value may still be a number when written by other encoders.
+	IsJSString bool
+	// Is64Bit is set for 64-bit integers, Int64 in the protoc-gen-dart
+	// classes, and IsTimestamp for google.protobuf.Timestamp fields, typed
+	// DateTime. IsAny is set for google.protobuf.Any fields.
+	Is64Bit     bool
+	IsTimestamp bool
+	IsAny       bool
+	// CaseName is the capitalized field name, naming its oneof case class.
+	CaseName   string
+	IsEnum     bool
+	IsRepeated bool
+	// IsRequired is set for proto2 required fields.
+	IsRequired bool
+	// HasPresence is set for singular fields tracking whether they are set:
+	// proto2 optional fields, and proto3 optional and oneof fields.
+	HasPresence   bool
 	IsMap         bool
 	MapKeyField   *ModelField
 	MapValueField *ModelField
 }
 
-type Service struct {
-	Name    string
-	Package string
-	Methods []ServiceMethod
+type Enum struct {
+	Name   string
+	Class  string
+	Values []*EnumValue
+}
+
+// EnumValue is a distinct enum number. With allow_alias several names share a
+// number, the first declared one is canonical and the others are Aliases.
+type EnumValue struct {
+	Name    string
+	Number  int32
+	Aliases []string
+}
+
+type Service struct {
+	// Name is the Dart name of the service interface, ProtoName the name
+	// of the proto service used in request paths.
+	Name      string
+	ProtoName string
+	// FullName is the package qualified proto name, e.g. example.Haberdasher.
+	FullName string
+	Package  string
+	// PathPrefix precedes the method names in request paths, e.g.
+	// /twirp/example.Haberdasher/ with the default rpc_path_segment.
+	PathPrefix string
+	Methods    []ServiceMethod
+}
+
+type ServiceMethod struct {
+	Name       string
+	Path       string
+	InputArg   string
+	InputType  string
+	OutputType string
+	// ReturnType is the type the method resolves to, List<OutputType> for
+	// methods with the (twirp_dart.list_output) option.
+	ReturnType    string
+	ListOutput    bool
+	NoSideEffects bool
+	// Idempotent methods are retried on 5xx responses.
+	Idempotent bool
+	// Origin names the proto file, line and rpc the method is generated from.
+	Origin string
+	// Route identifies the rpc in exceptions, e.g. example.Haberdasher/MakeHat.
+	Route string
+	// DefaultTimeout is the (twirp_dart.timeout_ms) option, the default
+	// timeout of a request in milliseconds, 0 for none.
+	DefaultTimeout uint32
+	// Encoding is the (twirp_dart.encoding) option, "json" or "protobuf"
+	// to use that encoding whatever the client.
+	Encoding string
+	// Deprecated is set by option deprecated = true on the rpc.
+	Deprecated bool
+	// Validate is set when the input has required fields to check with
+	// the validate_required option.
+	Validate bool
+	// QueryFields are the scalar fields of the input of a method with the
+	// (twirp_dart.get_safe) option, encoded by its query helper.
+	QueryFields []ModelField
+	// PositionalFields are the fields of a scalar-only input with the
+	// positional_args option, the arguments of the <method>With shorthand.
+	PositionalFields []ModelField
+	// Health is set for the method named by the health_method option, and
+	// HealthStatus is the Dart expression reading the status name from its
+	// response, empty when the output has no status field.
+	Health       bool
+	HealthStatus string
+}
+
+// Version is the plugin version, reported in the header of the generated files
+// and the default User-Agent of the clients. Release builds set it with
+// -ldflags "-X github.com/unicomp21/protoc-gen-twirp_dart/generator.Version=v1.2.3".
+var Version = "dev"
+
+func NewAPIContext() APIContext {
+	ctx := APIContext{}
+	ctx.UserAgent = "twirp-dart/" + Version
+	ctx.modelLookup = make(map[string]*Model)
+
+	return ctx
+}
+
+type APIContext struct {
+	Models   []*Model
+	Enums    []*Enum
+	Services []*Service
+	Imports  []Import
+	// ClientImports are the imports of the client file when split_interfaces is set.
+	ClientImports []Import
+	// LibraryName, LibraryFile and PartFile name the library and its models
+	// part when part_files is set.
+	LibraryName string
+	LibraryFile string
+	PartFile    string
+	UserAgent   string
+	Options     Options
+	// MetaModel is the model the meta_type option names when it is defined
+	// in this file.
+	MetaModel *Model
+	// ErrorEnum is the enum the error_enum option names when it is defined
+	// in this file.
+	ErrorEnum *Enum
+	// FreezedFile is the generated file without its .dart extension, naming
+	// the freezed and json_serializable parts with use_freezed.
+	FreezedFile string
+	// FreezedEnums are the enums of the freezed fields, FreezedBytes is set
+	// when one of them holds bytes. Both need a JsonConverter.
+	FreezedEnums []string
+	FreezedBytes bool
+
+	header      string
+	modelLookup map[string]*Model
+	registry    *Registry
+}
+
+type Import struct {
+	Path string
+}
+
+func (ctx *APIContext) AddModel(m *Model) {
+	ctx.Models = append(ctx.Models, m)
+	ctx.modelLookup[m.Name] = m
+}
+
+func (ctx *APIContext) ApplyImports(d *descriptor.FileDescriptorProto) {
+	var deps []Import
+	var clientDeps []Import
+
+	if len(ctx.Services) > 0 {
+		clientDeps = append(clientDeps, Import{"dart:async"})
+		clientDeps = append(clientDeps, Import{"package:http/http.dart"})
+		// TypeRegistry, and GeneratedMessage for content_type_dispatch
+		if !ctx.Options.Pure {
+			clientDeps = append(clientDeps, Import{"package:protobuf/protobuf.dart"})
+		}
+		if ctx.Options.Reflection {
+			clientDeps = append(clientDeps, Import{"dart:typed_data"})
+		}
+		clientDeps = append(clientDeps, Import{"dart:convert"})
+	}
+	if ctx.hasBytesFields() {
+		// the JSON of bytes fields is base64
+		deps = append(deps, Import{"dart:typed_data"}, Import{"dart:convert"})
+	}
+	if ctx.UsesFieldMask() {
+		deps = append(deps, Import{"package:protobuf/well_known_types/google/protobuf/field_mask.pb.dart"})
+	}
+	if ctx.UsesValue() {
+		deps = append(deps, Import{"package:protobuf/well_known_types/google/protobuf/struct.pb.dart"})
+	}
+	if ctx.UsesAny() {
+		deps = append(deps, Import{"package:protobuf/protobuf.dart"})
+		deps = append(deps, Import{"package:protobuf/well_known_types/google/protobuf/any.pb.dart"})
+	}
+	if ctx.Options.UseFreezed {
+		deps = append(deps, Import{"dart:convert"})
+		deps = append(deps, Import{"package:freezed_annotation/freezed_annotation.dart"})
+		deps = append(deps, Import{"package:json_annotation/json_annotation.dart"})
+	}
+	// the models convert to the Int64 and Timestamp of the protoc-gen-dart classes
+	if !ctx.Options.Pure && ctx.uses64Bit() {
+		deps = append(deps, Import{"package:fixnum/fixnum.dart"})
+	}
+	if !ctx.Options.Pure && ctx.usesTimestamp() {
+		deps = append(deps, Import{"package:protobuf/well_known_types/google/protobuf/timestamp.pb.dart"})
+	}
+
+	// the client file of split_interfaces imports the .pb.dart too
+	var splitDeps []Import
+
+	// pure files define the models themselves and import no other file
+	if !ctx.Options.Pure {
+		pbImport := relativeImport(d.GetName(), pbFilename(d.GetName()))
+		if prefix := ctx.Options.ImportPrefix; prefix != "" {
+			pbImport = packageImport(prefix, pbFilename(d.GetName()))
+		}
+		deps = append(deps, Import{pbImport})
+		splitDeps = append(splitDeps, Import{pbImport})
+
+		// messages defined in other files of the same request need their .pb.dart imported
+		for _, file := range ctx.referencedFiles(d) {
+			if prefix := ctx.Options.ImportPrefix; prefix != "" {
+				deps = append(deps, Import{packageImport(prefix, pbFilename(file))})
+				continue
+			}
+			deps = append(deps, Import{relativeImport(d.GetName(), pbFilename(file))})
+		}
+
+		for _, dep := range d.Dependency {
+			if IsWellKnownFile(dep) {
+				continue
+			}
+			if prefix := ctx.Options.ImportPrefix; prefix != "" {
+				deps = append(deps, Import{packageImport(prefix, twirpFilename(dep))})
+				continue
+			}
+			importPath := path.Dir(dep)
+			sourceDir := path.Dir(*d.Name)
+			sourceComponents := strings.Split(sourceDir, fmt.Sprintf("%c", os.PathSeparator))
+			distanceFromRoot := len(sourceComponents)
+			for _, pathComponent := range sourceComponents {
+				if strings.HasPrefix(importPath, pathComponent) {
+					importPath = strings.TrimPrefix(importPath, pathComponent)
+					distanceFromRoot--
+				}
+			}
+			fileName := dartFilename(dep)
+			fullPath := fileName
+			fullPath = path.Join(importPath, fullPath)
+			if distanceFromRoot > 0 {
+				for i := 0; i < distanceFromRoot; i++ {
+					fullPath = path.Join("..", fullPath)
+				}
+			}
+			deps = append(deps, Import{fullPath})
+		}
+	}
+
+	if !ctx.Options.SplitInterfaces {
+		ctx.Imports = sortImports(append(clientDeps, deps...))
+		return
+	}
+
+	// the client file builds on the interface file, which must not depend on package:http
+	interfaceImport := relativeImport(dartClientFilename(d), dartModuleFilename(d))
+	if prefix := ctx.Options.ImportPrefix; prefix != "" {
+		interfaceImport = packageImport(prefix, dartModuleFilename(d))
+	}
+	clientDeps = append(append(clientDeps, splitDeps...), Import{interfaceImport})
+
+	ctx.Imports = sortImports(deps)
+	ctx.ClientImports = sortImports(clientDeps)
 }
 
-type ServiceMethod struct {
-	Name       string
-	Path       string
-	InputArg   string
-	InputType  string
-	OutputType string
+// sortImports orders imports the way the Dart directives_ordering lint
+// expects: dart: imports, then package: imports, then relative imports, each
+// sorted by path. Duplicates are dropped so the output is reproducible.
+func sortImports(imports []Import) []Import {
+	group := func(p string) int {
+		switch {
+		case strings.HasPrefix(p, "dart:"):
+			return 0
+		case strings.HasPrefix(p, "package:"):
+			return 1
+		}
+		return 2
+	}
+
+	seen := make(map[string]bool)
+	var sorted []Import
+	for _, i := range imports {
+		if seen[i.Path] {
+			continue
+		}
+		seen[i.Path] = true
+		sorted = append(sorted, i)
+	}
+
+	sort.SliceStable(sorted, func(a, b int) bool {
+		ga, gb := group(sorted[a].Path), group(sorted[b].Path)
+		if ga != gb {
+			return ga < gb
+		}
+		return sorted[a].Path < sorted[b].Path
+	})
+
+	return sorted
 }
 
-func NewAPIContext() APIContext {
-	ctx := APIContext{}
-	ctx.modelLookup = make(map[string]*Model)
+// isWellKnownType reports whether the message field f has a google.protobuf
+// type that has no generated model. A message of the file may share the Dart
+// name, so the proto type name decides.
+func isWellKnownType(f ModelField) bool {
+	return f.IsTimestamp || f.IsAny
+}
 
-	return ctx
+// UsesFieldMask reports whether a model has a google.protobuf.FieldMask field.
+func (ctx APIContext) UsesFieldMask() bool {
+	for _, m := range ctx.Models {
+		for _, f := range m.Fields {
+			if f.IsFieldMask {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-type APIContext struct {
-	Models      []*Model
-	Services    []*Service
-	Imports     []Import
-	modelLookup map[string]*Model
+// UsesValue reports whether a model has a google.protobuf.Value field or
+// map value.
+func (ctx APIContext) UsesValue() bool {
+	for _, m := range ctx.Models {
+		for _, f := range m.Fields {
+			if f.IsValue || f.IsValueMap() {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-type Import struct {
-	Path string
+// UsesAny reports whether a model has a google.protobuf.Any field.
+func (ctx APIContext) UsesAny() bool {
+	for _, m := range ctx.Models {
+		for _, f := range m.Fields {
+			if f.IsMap {
+				f = *f.MapValueField
+			}
+			if f.IsAny {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (ctx *APIContext) AddModel(m *Model) {
-	ctx.Models = append(ctx.Models, m)
-	ctx.modelLookup[m.Name] = m
+func (ctx *APIContext) hasBytesFields() bool {
+	for _, m := range ctx.Models {
+		for _, f := range m.Fields {
+			if f.IsBytes {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (ctx *APIContext) ApplyImports(d *descriptor.FileDescriptorProto) {
-	var deps []Import
+// referencedFiles returns, in order of first use, the other proto files that
+// define message types used by the fields and methods of d.
+func (ctx *APIContext) referencedFiles(d *descriptor.FileDescriptorProto) []string {
+	var typeNames []string
+	var walk func(messages []*descriptor.DescriptorProto)
+	walk = func(messages []*descriptor.DescriptorProto) {
+		for _, m := range messages {
+			for _, f := range m.GetField() {
+				switch f.GetType() {
+				case descriptor.FieldDescriptorProto_TYPE_MESSAGE, descriptor.FieldDescriptorProto_TYPE_ENUM:
+					typeNames = append(typeNames, f.GetTypeName())
+				}
+			}
+			walk(m.GetNestedType())
+		}
+	}
+	walk(d.GetMessageType())
 
-	if len(ctx.Services) > 0 {
-		deps = append(deps, Import{"dart:async"})
-		deps = append(deps, Import{"package:http/http.dart"})
+	for _, s := range d.GetService() {
+		for _, m := range s.GetMethod() {
+			typeNames = append(typeNames, m.GetInputType(), m.GetOutputType())
+		}
 	}
-	deps = append(deps, Import{"dart:convert"})
-	deps = append(deps, Import{strings.Replace(d.GetName(), ".proto", "", -1) + ".pb.dart"})
 
-	for _, dep := range d.Dependency {
-		if dep == "google/protobuf/timestamp.proto" {
+	var files []string
+	seen := map[string]bool{d.GetName(): true}
+	for _, name := range typeNames {
+		file, ok := ctx.registry.FileOf(name)
+		if !ok {
+			file, ok = ctx.registry.EnumFileOf(name)
+		}
+		if !ok {
+			// an enum nested in a message is defined in the file of the message
+			file, ok = ctx.registry.FileOf(name[:strings.LastIndex(name, ".")])
+		}
+		if !ok || seen[file] || IsWellKnownFile(file) {
 			continue
 		}
-		importPath := path.Dir(dep)
-		sourceDir := path.Dir(*d.Name)
-		sourceComponents := strings.Split(sourceDir, fmt.Sprintf("%c", os.PathSeparator))
-		distanceFromRoot := len(sourceComponents)
-		for _, pathComponent := range sourceComponents {
-			if strings.HasPrefix(importPath, pathComponent) {
-				importPath = strings.TrimPrefix(importPath, pathComponent)
-				distanceFromRoot--
-			}
+		seen[file] = true
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// markRPCModels only includes the custom 'ToJSON' and 'JSONTo' methods in
+// generated code if the Model is part of an rpc method input arg or return
+// type. The rpc types are collected first so large files are marked in
+// O(models + methods).
+func (ctx *APIContext) markRPCModels() {
+	inputs := map[string]bool{}
+	outputs := map[string]bool{}
+	for _, s := range ctx.Services {
+		for _, sm := range s.Methods {
+			inputs[sm.InputType] = true
+			outputs[sm.OutputType] = true
 		}
-		fileName := dartFilename(dep)
-		fullPath := fileName
-		fullPath = path.Join(importPath, fullPath)
-		if distanceFromRoot > 0 {
-			for i := 0; i < distanceFromRoot; i++ {
-				fullPath = path.Join("..", fullPath)
-			}
+	}
+
+	for _, m := range ctx.Models {
+		if inputs[m.Name] {
+			m.CanMarshal = true
+		}
+		if outputs[m.Name] {
+			m.CanUnmarshal = true
 		}
-		deps = append(deps, Import{fullPath})
 	}
-	ctx.Imports = deps
 }
 
 // ApplyMarshalFlags will inspect the CanMarshal and CanUnmarshal flags for models where
 // the flags are enabled and recursively set the same values on all the models that are field types.
-
 func (ctx *APIContext) ApplyMarshalFlags() {
 	for _, m := range ctx.Models {
 		for _, f := range m.Fields {
-			// skip primitive types and WKT Timestamps
-			if !f.IsMessage || f.Type == "DateTime" {
+			name, ok := fieldModelName(f)
+			if !ok {
 				continue
 			}
 
-			baseType := f.Type
-			if f.IsRepeated {
-				baseType = strings.Replace(baseType, "List<", "", -1)
-				baseType = strings.Replace(baseType, ">", "", -1)
-			}
 			if m.CanMarshal {
-				ctx.enableMarshal(ctx.modelLookup[baseType])
+				ctx.enableMarshal(ctx.fieldModel(name, f))
 			}
 
 			if m.CanUnmarshal {
-				m, ok := ctx.modelLookup[baseType]
-				if !ok {
-					log.Fatalf("could not find model of type %s for field %s", baseType, f.Name)
-				}
-				ctx.enableUnmarshal(m)
+				ctx.enableUnmarshal(ctx.fieldModel(name, f))
 			}
 		}
 	}
 }
 
+// fieldModelName returns the name of the model holding the values of f: the
+// message type of singular and repeated fields, the value type of maps.
+// Scalars and well known types have no model.
+func fieldModelName(f ModelField) (string, bool) {
+	if f.IsMap {
+		f = *f.MapValueField
+	}
+
+	// skip primitive and well known types
+	if !f.IsMessage || isWellKnownType(f) {
+		return "", false
+	}
+
+	if f.IsRepeated {
+		return f.InternalType, true
+	}
+	return f.Type, true
+}
+
+func (ctx *APIContext) fieldModel(name string, f ModelField) *Model {
+	m, ok := ctx.modelLookup[name]
+	if !ok {
+		log.Fatalf("could not find model of type %s for field %s", name, f.Name)
+	}
+
+	return m
+}
+
 func (ctx *APIContext) enableMarshal(m *Model) {
+	if m.CanMarshal {
+		return
+	}
 	m.CanMarshal = true
 
 	for _, f := range m.Fields {
-		// skip primitive types and WKT Timestamps
-		if !f.IsMessage || f.Type == "DateTime" {
-			continue
+		if name, ok := fieldModelName(f); ok {
+			ctx.enableMarshal(ctx.fieldModel(name, f))
 		}
-		mm, ok := ctx.modelLookup[f.Type]
-		if !ok {
-			log.Fatalf("could not find model of type %s for field %s", f.Type, f.Name)
-		}
-		ctx.enableMarshal(mm)
 	}
 }
 
 func (ctx *APIContext) enableUnmarshal(m *Model) {
+	if m.CanUnmarshal {
+		return
+	}
 	m.CanUnmarshal = true
 
 	for _, f := range m.Fields {
-		// skip primitive types and WKT Timestamps
-		if !f.IsMessage || f.Type == "DateTime" {
-			continue
+		if name, ok := fieldModelName(f); ok {
+			ctx.enableUnmarshal(ctx.fieldModel(name, f))
 		}
-		mm, ok := ctx.modelLookup[f.Type]
-		if !ok {
-			log.Fatalf("could not find model of type %s for field %s", f.Type, f.Name)
-		}
-		ctx.enableUnmarshal(mm)
 	}
 }
 
-func CreateClientAPI(d *descriptor.FileDescriptorProto, generator *generator.Generator) (*plugin_go.CodeGeneratorResponse_File, error) {
+// CreateClientAPI generates the Dart client for d. It returns a single file, or
+// an interface file and a client file when the split_interfaces option is set.
+func CreateClientAPI(d *descriptor.FileDescriptorProto, generator *generator.Generator, registry *Registry, opts Options) ([]*plugin_go.CodeGeneratorResponse_File, error) {
 	ctx := NewAPIContext()
+	ctx.registry = registry
+	ctx.Options = opts
 	pkg := d.GetPackage()
 
 	// Parse all Messages for generating typescript interfaces
 
 	for _, m := range d.GetMessageType() {
 		model := &Model{
-			Name: m.GetName(),
+			Name:  opts.TypePrefix + m.GetName(),
+			Class: m.GetName(),
 		}
 		for _, f := range m.GetField() {
-			model.Fields = append(model.Fields, newField(f, m, d, generator))
+			field, err := newField(f, m, d, generator, registry, opts)
+			if err != nil {
+				return nil, err
+			}
+			model.Fields = append(model.Fields, field)
 		}
+		model.Oneofs = newOneofs(m, model)
 		ctx.AddModel(model)
 
 	}
 
+	if err := checkReferences(d, registry); err != nil {
+		return nil, err
+	}
+	if opts.Pure {
+		if err := checkPure(d); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range d.GetEnumType() {
+		ctx.Enums = append(ctx.Enums, newEnum(e, opts))
+	}
+
+	if opts.MetaType != "" {
+		meta, err := metaModel(d, ctx, registry, opts)
+		if err != nil {
+			return nil, err
+		}
+		ctx.MetaModel = meta
+	}
+
+	if opts.ErrorEnum != "" {
+		errorEnum, err := errorEnum(d, ctx, registry, opts)
+		if err != nil {
+			return nil, err
+		}
+		ctx.ErrorEnum = errorEnum
+	}
+
+	if opts.ErrorStyle == "result" && len(d.GetService()) > 0 {
+		if _, ok := ctx.modelLookup["Result"]; ok {
+			return nil, fmt.Errorf("%s: error_style=result generates a Result class, which collides with the message Result", d.GetName())
+		}
+	}
+	if opts.ErrorStyle == "sealed" && len(d.GetService()) > 0 {
+		for _, name := range []string{"TwirpResult", "Ok", "Err"} {
+			if _, ok := ctx.modelLookup[name]; ok {
+				return nil, fmt.Errorf("%s: error_style=sealed generates a %s class, which collides with the message %s", d.GetName(), name, name)
+			}
+		}
+	}
+
 	// Parse all Services for generating typescript method interfaces and default client implementations
-	for _, s := range d.GetService() {
+	for si, s := range d.GetService() {
+		name, err := serviceName(opts.TypePrefix+s.GetName(), ctx)
+		if err != nil {
+			return nil, err
+		}
 		service := &Service{
-			Name:    s.GetName(),
-			Package: pkg,
+			Name:      name,
+			ProtoName: s.GetName(),
+			FullName:  s.GetName(),
+			Package:   pkg,
 		}
+		if pkg != "" {
+			service.FullName = pkg + "." + s.GetName()
+		}
+		service.PathPrefix = "/" + opts.RPCPathSegment + "/" + service.FullName + "/"
 
-		for _, m := range s.GetMethod() {
-			methodPath := m.GetName()
-			methodName := strings.ToLower(methodPath[0:1]) + methodPath[1:]
-			in := removePkg(m.GetInputType())
-			arg := strings.ToLower(in[0:1]) + in[1:]
+		for mi, m := range s.GetMethod() {
+			methodPath := rpcPath(m.GetName(), opts)
+			methodName := strings.ToLower(m.GetName()[0:1]) + m.GetName()[1:]
+			in := dartClassName(m.GetInputType(), d, registry, opts)
+			arg := argName(removePkg(m.GetInputType()))
 
 			method := ServiceMethod{
 				Name:       methodName,
 				Path:       methodPath,
 				InputArg:   arg,
 				InputType:  in,
-				OutputType: removePkg(m.GetOutputType()),
+				OutputType: dartClassName(m.GetOutputType(), d, registry, opts),
+				ReturnType: dartClassName(m.GetOutputType(), d, registry, opts),
+				ListOutput: boolMethodOption(m, E_ListOutput),
+				Origin:     methodOrigin(d, si, mi),
+				Route:      service.FullName + "/" + methodPath,
+
+				NoSideEffects: m.GetOptions().GetIdempotencyLevel() == descriptor.MethodOptions_NO_SIDE_EFFECTS,
+				Idempotent:    m.GetOptions().GetIdempotencyLevel() != descriptor.MethodOptions_IDEMPOTENCY_UNKNOWN,
+				Deprecated:    m.GetOptions().GetDeprecated(),
+				Encoding:      stringMethodOption(m, E_Encoding),
+
+				DefaultTimeout: uint32MethodOption(m, E_TimeoutMs),
+			}
+			if method.ListOutput {
+				method.ReturnType = "List<" + method.OutputType + ">"
+			}
+			switch {
+			case method.Encoding != "" && method.Encoding != "json" && method.Encoding != "protobuf":
+				return nil, fmt.Errorf("%s: invalid (twirp_dart.encoding) %q, expected json or protobuf", method.Origin, method.Encoding)
+			case method.ListOutput && method.Encoding == "protobuf":
+				return nil, fmt.Errorf("%s: (twirp_dart.list_output) methods can't use the protobuf encoding", method.Origin)
+			}
+			if input, ok := ctx.modelLookup[in]; ok && opts.ValidateRequired {
+				method.Validate = input.HasRequired()
+			}
+			if boolMethodOption(m, E_GetSafe) {
+				input, ok := ctx.modelLookup[in]
+				if !ok {
+					return nil, fmt.Errorf("%s: (twirp_dart.get_safe) needs the input message %s to be defined in the file", method.Origin, m.GetInputType())
+				}
+				method.QueryFields = queryFields(input)
+			}
+			if opts.HealthMethod != "" && m.GetName() == opts.HealthMethod {
+				if method.ListOutput {
+					return nil, fmt.Errorf("%s: the health_method can't have the (twirp_dart.list_output) option", method.Origin)
+				}
+				method.Health = true
+				method.HealthStatus = healthStatus(ctx.modelLookup[method.OutputType])
+			}
+			if input, ok := ctx.modelLookup[in]; ok && opts.PositionalArgs {
+				// setting the fields of a oneof one after the other would
+				// only keep the last one
+				if fields := queryFields(input); len(fields) > 0 && len(fields) == len(input.Fields) && len(input.Oneofs) == 0 {
+					method.PositionalFields = fields
+				}
 			}
 
 			service.Methods = append(service.Methods, method)
 		}
 		ctx.Services = append(ctx.Services, service)
 	}
-	// Only include the custom 'ToJSON' and 'JSONTo' methods in generated code
-	// if the Model is part of an rpc method input arg or return type.
-	for _, m := range ctx.Models {
-		for _, s := range ctx.Services {
-			for _, sm := range s.Methods {
-				if m.Name == sm.InputType {
-					m.CanMarshal = true
-				}
+	ctx.markRPCModels()
 
-				if m.Name == sm.OutputType {
-					m.CanUnmarshal = true
-				}
-			}
+	if opts.UseFreezed {
+		if err := ctx.applyFreezed(d); err != nil {
+			return nil, err
 		}
 	}
 
-	ctx.AddModel(&Model{
-		Name:      "Date",
-		Primitive: true,
-	})
+	if len(ctx.Services) > 0 {
+		ctx.AddModel(&Model{
+			Name:      "DateTime",
+			Primitive: true,
+		})
+	}
 
 	ctx.ApplyImports(d)
 	//ctx.ApplyMarshalFlags()
 
 	funcMap := template.FuncMap{
-		"stringify": stringify,
-		"parse":     parse,
+		"stringify":    stringify,
+		"parse":        parse,
+		"defaultValue": defaultValue,
+		"dict":         dict,
+		"pureField":    pureField,
+		"pureToJSON":   pureToJSON,
+		"queryValue":   queryValue,
+		// pure models keep the Dart types, there is nothing to convert
+		"protoValue": func(f ModelField, value string) string {
+			if ctx.Options.Pure {
+				return value
+			}
+			return protoValue(f, value)
+		},
+		"protoValues": func(f ModelField, value string) string {
+			if ctx.Options.Pure {
+				return value
+			}
+			return protoValues(f, value)
+		},
+		"dartValue": func(f ModelField, value string) string {
+			if ctx.Options.Pure {
+				return value
+			}
+			return dartValue(f, value)
+		},
 	}
 
-	t, err := template.New("client_api").Funcs(funcMap).Parse(apiTemplate)
+	t, err := template.New("api").Funcs(funcMap).Parse(apiTemplate)
 	if err != nil {
 		return nil, err
 	}
 
-	b := bytes.NewBufferString("")
-	err = t.Execute(b, ctx)
+	if ctx.header, err = fileHeader(d); err != nil {
+		return nil, err
+	}
+
+	var files []*plugin_go.CodeGeneratorResponse_File
+	if opts.PartFiles {
+		ctx.LibraryName = dartLibraryName(d)
+		ctx.LibraryFile = path.Base(dartModuleFilename(d))
+		ctx.PartFile = path.Base(dartModelsFilename(d))
+	}
+
+	if !opts.SplitInterfaces {
+		cf, err := executeFile(t, "client_api", dartModuleFilename(d), ctx)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, cf)
+	} else {
+		interfaces, err := executeFile(t, "interface_file", dartModuleFilename(d), ctx)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, interfaces)
+		// a file without services has no clients
+		if len(ctx.Services) > 0 {
+			clients, err := executeFile(t, "client_file", dartClientFilename(d), ctx)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, clients)
+		}
+	}
+
+	if opts.PartFiles {
+		models, err := executeFile(t, "models_file", dartModelsFilename(d), ctx)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, models)
+	}
+
+	if opts.DeprecatedFile {
+		for _, s := range ctx.Services {
+			sctx := ctx
+			sctx.Services = []*Service{s}
+			deprecated, err := executeFile(t, "deprecated_file", dartDeprecatedFilename(s), sctx)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, deprecated)
+		}
+	}
+
+	return files, nil
+}
+
+// metaModel returns the model of d named by the meta_type option, a fully
+// qualified message name. It is nil when the message is defined in another
+// file of the request.
+func metaModel(d *descriptor.FileDescriptorProto, ctx APIContext, registry *Registry, opts Options) (*Model, error) {
+	name := "." + opts.MetaType
+	for _, m := range d.GetMessageType() {
+		if name == fullMessageName(d, m) {
+			return ctx.modelLookup[opts.TypePrefix+m.GetName()], nil
+		}
+	}
+
+	if _, ok := registry.FileOf(name); ok || registry == nil {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("meta_type %s: no such top-level message", opts.MetaType)
+}
+
+// errorEnum returns the enum of d named by the error_enum option, a fully
+// qualified enum name. It is nil when the enum is defined in another file of
+// the request.
+func errorEnum(d *descriptor.FileDescriptorProto, ctx APIContext, registry *Registry, opts Options) (*Enum, error) {
+	prefix := ""
+	if d.GetPackage() != "" {
+		prefix = d.GetPackage() + "."
+	}
+	for i, e := range d.GetEnumType() {
+		if opts.ErrorEnum == prefix+e.GetName() {
+			return ctx.Enums[i], nil
+		}
+	}
+
+	if _, ok := registry.EnumFileOf("." + opts.ErrorEnum); ok || registry == nil {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("error_enum %s: no such top-level enum", opts.ErrorEnum)
+}
+
+// checkPure verifies that the types used by d can be generated into a pure
+// file: its top-level messages and enums, maps and Timestamps.
+func checkPure(d *descriptor.FileDescriptorProto) error {
+	prefix := ""
+	if d.GetPackage() != "" {
+		prefix = "." + d.GetPackage()
+	}
+	types := map[string]bool{".google.protobuf.Timestamp": true}
+	for _, m := range d.GetMessageType() {
+		types[prefix+"."+m.GetName()] = true
+	}
+	for _, e := range d.GetEnumType() {
+		types[prefix+"."+e.GetName()] = true
+	}
+
+	var check func(m *descriptor.DescriptorProto, name string) error
+	check = func(m *descriptor.DescriptorProto, name string) error {
+		if len(m.GetEnumType()) > 0 {
+			return fmt.Errorf("%s: pure files don't support the nested enum %s.%s", d.GetName(), name, m.GetEnumType()[0].GetName())
+		}
+		entries := map[string]bool{}
+		for _, nested := range m.GetNestedType() {
+			if !nested.GetOptions().GetMapEntry() {
+				return fmt.Errorf("%s: pure files don't support the nested message %s.%s", d.GetName(), name, nested.GetName())
+			}
+			entries[name+"."+nested.GetName()] = true
+			if err := check(nested, name+"."+nested.GetName()); err != nil {
+				return err
+			}
+		}
+		for _, f := range m.GetField() {
+			typeName := f.GetTypeName()
+			if typeName == "" || types[typeName] || entries[typeName] {
+				continue
+			}
+			return fmt.Errorf("%s: field %s of %s has the type %s, pure files only support the messages and enums of the file", d.GetName(), f.GetName(), name, typeName)
+		}
+		return nil
+	}
+
+	for _, m := range d.GetMessageType() {
+		if err := check(m, prefix+"."+m.GetName()); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range d.GetService() {
+		for _, m := range s.GetMethod() {
+			for _, typeName := range []string{m.GetInputType(), m.GetOutputType()} {
+				if !types[typeName] || typeName == ".google.protobuf.Timestamp" {
+					return fmt.Errorf("%s: rpc %s.%s uses %s, pure files only support the messages of the file", d.GetName(), s.GetName(), m.GetName(), typeName)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// handledWellKnownTypes are the google.protobuf messages mapped to Dart types
+// by protoToDartType, they needn't be part of the request.
+var handledWellKnownTypes = map[string]bool{
+	".google.protobuf.Any":       true,
+	".google.protobuf.FieldMask": true,
+	".google.protobuf.Timestamp": true,
+	".google.protobuf.Value":     true,
+}
+
+// checkReferences verifies that the message typed fields of d, including those
+// of nested messages, refer to a message of d, of another file of the request
+// or to a handled well known type. Otherwise the generated Dart code would
+// only fail to compile.
+func checkReferences(d *descriptor.FileDescriptorProto, registry *Registry) error {
+	local := NewRegistry([]*descriptor.FileDescriptorProto{d})
+
+	var check func(messages []*descriptor.DescriptorProto) error
+	check = func(messages []*descriptor.DescriptorProto) error {
+		for _, m := range messages {
+			for _, f := range m.GetField() {
+				if f.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+					continue
+				}
+				name := f.GetTypeName()
+				if _, ok := local.FileOf(name); ok || handledWellKnownTypes[name] {
+					continue
+				}
+				if _, ok := registry.FileOf(name); ok {
+					continue
+				}
+				return fmt.Errorf("%s: field %s in message %s refers to the unknown message type %s", d.GetName(), f.GetName(), m.GetName(), name)
+			}
+			if err := check(m.GetNestedType()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return check(d.GetMessageType())
+}
+
+// fileHeader returns the comment starting every generated file. It names the
+// plugin version and the source proto, and has the SHA-256 of the serialized
+// descriptor so audits can tell which input a file was generated from.
+func fileHeader(d *descriptor.FileDescriptorProto) (string, error) {
+	data, err := proto.Marshal(d)
 	if err != nil {
+		return "", fmt.Errorf("hashing %s: %v", d.GetName(), err)
+	}
+	sum := sha256.Sum256(data)
+
+	return fmt.Sprintf("// Code generated by protoc-gen-twirp_dart %s. DO NOT EDIT.\n// source: %s\n// descriptor sha256: %x\n", Version, d.GetName(), sum), nil
+}
+
+func executeFile(t *template.Template, name, filename string, ctx APIContext) (*plugin_go.CodeGeneratorResponse_File, error) {
+	b := bytes.NewBufferString("")
+	if err := t.ExecuteTemplate(b, name, ctx); err != nil {
 		return nil, err
 	}
 
+	content := formatDart(ctx.header+b.String(), ctx.Options.IndentSpaces)
+
 	cf := &plugin_go.CodeGeneratorResponse_File{}
-	cf.Name = proto.String(dartModuleFilename(d))
-	cf.Content = proto.String(b.String())
+	cf.Name = proto.String(filename)
+	cf.Content = proto.String(content)
 
 	return cf, nil
 }
 
+// formatDart indents src with spaces instead of tabs, the way dart format
+// does: every leading tab becomes spaces, trailing whitespace is dropped and
+// runs of blank lines are collapsed to one. With zero spaces the tabs are
+// kept.
+func formatDart(src string, spaces int) string {
+	indent := strings.Repeat(" ", spaces)
+	if spaces == 0 {
+		indent = "\t"
+	}
+	var out []string
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(line, " \t")
+		trimmed := strings.TrimLeft(line, "\t")
+		if trimmed == "" && len(out) > 0 && out[len(out)-1] == "" {
+			continue
+		}
+		out = append(out, strings.Repeat(indent, len(line)-len(trimmed))+trimmed)
+	}
+	return strings.Join(out, "\n")
+}
+
+// newOneofs groups the fields of model by the oneofs of m. The synthetic
+// oneofs of proto3 optional fields, named after the field with a leading
+// underscore, are skipped.
+func newOneofs(m *descriptor.DescriptorProto, model *Model) []*Oneof {
+	var oneofs []*Oneof
+	for i, o := range m.GetOneofDecl() {
+		if strings.HasPrefix(o.GetName(), "_") {
+			continue
+		}
+		name := camelCase(o.GetName())
+		caseName := strings.ToUpper(name[:1]) + name[1:]
+		oneof := &Oneof{
+			Name:      name,
+			CaseName:  caseName,
+			ClassName: model.Name + caseName,
+			Enum:      model.Class + "_" + caseName,
+		}
+		for j, f := range m.GetField() {
+			if f.OneofIndex != nil && int(f.GetOneofIndex()) == i {
+				oneof.Fields = append(oneof.Fields, model.Fields[j])
+			}
+		}
+		if len(oneof.Fields) > 0 {
+			oneofs = append(oneofs, oneof)
+		}
+	}
+	return oneofs
+}
+
+func newEnum(e *descriptor.EnumDescriptorProto, opts Options) *Enum {
+	enum := &Enum{Name: opts.TypePrefix + e.GetName(), Class: e.GetName()}
+	byNumber := make(map[int32]*EnumValue)
+
+	for _, v := range e.GetValue() {
+		if canonical, ok := byNumber[v.GetNumber()]; ok {
+			canonical.Aliases = append(canonical.Aliases, v.GetName())
+			continue
+		}
+		value := &EnumValue{Name: v.GetName(), Number: v.GetNumber()}
+		byNumber[v.GetNumber()] = value
+		enum.Values = append(enum.Values, value)
+	}
+
+	return enum
+}
+
 func newField(f *descriptor.FieldDescriptorProto,
 	m *descriptor.DescriptorProto,
 	d *descriptor.FileDescriptorProto,
-	gen *generator.Generator) ModelField {
-	dartType, internalType, jsonType := protoToDartType(f)
-	jsonName := f.GetName()
-	name := camelCase(jsonName)
+	gen *generator.Generator,
+	registry *Registry,
+	opts Options) (ModelField, error) {
+	dartType, internalType, jsonType, err := protoToDartType(f, d, registry, opts)
+	if err != nil {
+		return ModelField{}, fmt.Errorf("field %s in message %s: %v", f.GetName(), m.GetName(), err)
+	}
+	name := camelCase(f.GetName())
+	if renamed, ok := opts.Rename[m.GetName()+"."+f.GetName()]; ok {
+		name = renamed
+	} else if renamed, ok := opts.Rename[f.GetName()]; ok {
+		name = renamed
+	}
+
+	// protoc fills in json_name with the lowerCamelCase name unless the field
+	// overrides it, fall back to the proto name for hand built descriptors.
+	jsonName := f.GetJsonName()
+	if jsonName == "" || opts.UseProtoNames {
+		jsonName = f.GetName()
+	}
 
 	field := ModelField{
 		Name:         name,
+		CaseName:     strings.ToUpper(name[:1]) + name[1:],
 		Type:         dartType,
 		InternalType: internalType,
 		JSONName:     jsonName,
 		JSONType:     jsonType,
+		IsRequired:   f.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REQUIRED,
+		// proto3 optional fields are in a synthetic oneof
+		HasPresence: f.GetLabel() == descriptor.FieldDescriptorProto_LABEL_OPTIONAL && (d.GetSyntax() != "proto3" || f.OneofIndex != nil),
 	}
 
+	parent := fullMessageName(d, m)
 	for _, nested := range m.GetNestedType() {
-		if !strings.HasSuffix(f.GetTypeName(), nested.GetName()) {
+		if f.GetTypeName() != parent+"."+nested.GetName() {
 			continue
 		}
 		keyField, valueField := nested.GetMapFields()
 		if keyField != nil && valueField != nil {
 			field.IsMap = true
-			mapKeyField := newField(keyField, nested, d, gen)
+			mapKeyField, err := newField(keyField, nested, d, gen, registry, opts)
+			if err != nil {
+				return ModelField{}, err
+			}
 			field.MapKeyField = &mapKeyField
-			mapValueField := newField(valueField, nested, d, gen)
+			mapValueField, err := newField(valueField, nested, d, gen, registry, opts)
+			if err != nil {
+				return ModelField{}, err
+			}
 			field.MapValueField = &mapValueField
 			field.Type = fmt.Sprintf("Map<%s,%s>", mapKeyField.Type, mapValueField.Type)
 		}
 	}
-	field.IsMessage = f.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE
+	field.IsFieldMask = f.GetTypeName() == ".google.protobuf.FieldMask"
+	field.Is64Bit = is64Bit(f)
+	field.IsJSString = field.Is64Bit && f.GetOptions().GetJstype() == descriptor.FieldOptions_JS_STRING
+	field.IsTimestamp = f.GetTypeName() == ".google.protobuf.Timestamp"
+	field.IsAny = f.GetTypeName() == ".google.protobuf.Any"
+	field.IsValue = f.GetTypeName() == ".google.protobuf.Value"
+	field.IsMessage = f.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE && !field.IsFieldMask && !field.IsValue
+	field.IsBytes = f.GetType() == descriptor.FieldDescriptorProto_TYPE_BYTES
+	field.IsEnum = f.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM
 	field.IsRepeated = isRepeated(f)
 
-	return field
+	return field, nil
+}
+
+// fullMessageName returns the fully qualified name of the message m declared
+// in d, e.g. .example.Hat.Size, as used in field type names.
+func fullMessageName(d *descriptor.FileDescriptorProto, m *descriptor.DescriptorProto) string {
+	prefix := ""
+	if d.GetPackage() != "" {
+		prefix = "." + d.GetPackage()
+	}
+
+	var find func(scope string, messages []*descriptor.DescriptorProto) string
+	find = func(scope string, messages []*descriptor.DescriptorProto) string {
+		for _, msg := range messages {
+			name := scope + "." + msg.GetName()
+			if msg == m {
+				return name
+			}
+			if found := find(name, msg.GetNestedType()); found != "" {
+				return found
+			}
+		}
+		return ""
+	}
+
+	if name := find(prefix, d.GetMessageType()); name != "" {
+		return name
+	}
+	// m is not part of d, as for hand built descriptors in tests
+	return prefix + "." + m.GetName()
 }
 
 // generates the (Type, JSONType) tuple for a ModelField so marshal/unmarshal functions
 // will work when converting between TS interfaces and protobuf JSON.
-func protoToDartType(f *descriptor.FieldDescriptorProto) (string, string, string) {
+func protoToDartType(f *descriptor.FieldDescriptorProto, d *descriptor.FileDescriptorProto, registry *Registry, opts Options) (string, string, string, error) {
 	dartType := "String"
 	jsonType := "string"
 	internalType := "String"
 
 	switch f.GetType() {
-	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE,
+		descriptor.FieldDescriptorProto_TYPE_FLOAT:
 		dartType = "double"
 		jsonType = "number"
 		break
 	case descriptor.FieldDescriptorProto_TYPE_FIXED32,
 		descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64,
 		descriptor.FieldDescriptorProto_TYPE_INT32,
-		descriptor.FieldDescriptorProto_TYPE_INT64:
+		descriptor.FieldDescriptorProto_TYPE_INT64,
+		descriptor.FieldDescriptorProto_TYPE_UINT32,
+		descriptor.FieldDescriptorProto_TYPE_UINT64,
+		descriptor.FieldDescriptorProto_TYPE_SINT32,
+		descriptor.FieldDescriptorProto_TYPE_SINT64:
 		dartType = "int"
 		jsonType = "number"
+		// jstype = JS_STRING keeps 64-bit integers as decimal strings
+		if is64Bit(f) && f.GetOptions().GetJstype() == descriptor.FieldOptions_JS_STRING {
+			dartType = "String"
+			jsonType = "string"
+		}
 	case descriptor.FieldDescriptorProto_TYPE_STRING:
 		dartType = "String"
 		jsonType = "string"
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		// proto3 JSON encodes enums by value name
+		dartType = dartClassName(f.GetTypeName(), d, registry, opts)
+		jsonType = "string"
 	case descriptor.FieldDescriptorProto_TYPE_BOOL:
 		dartType = "bool"
 		jsonType = "boolean"
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		// proto3 JSON encodes bytes as base64 strings
+		dartType = "Uint8List"
+		jsonType = "string"
 	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
 		name := f.GetTypeName()
 
@@ -450,10 +2806,28 @@ func protoToDartType(f *descriptor.FieldDescriptorProto) (string, string, string
 		if name == ".google.protobuf.Timestamp" {
 			dartType = "DateTime"
 			jsonType = "string"
+		} else if name == ".google.protobuf.FieldMask" {
+			// proto3 JSON encodes a FieldMask as its paths joined by commas.
+			dartType = "List<String>"
+			jsonType = "string"
+		} else if name == ".google.protobuf.Value" {
+			// a google.protobuf.Value is any JSON value, models take and
+			// return it as is and convert it with JSONToValue/ValueToJSON.
+			dartType = "dynamic"
+			jsonType = "any"
+		} else if name == ".google.protobuf.Any" {
+			// the well known Any message from package:protobuf holds the typeUrl
+			// and value bytes, its JSON form is passed through AnyToJSON/JSONToAny.
+			dartType = "Any"
+			jsonType = "object"
 		} else {
-			dartType = removePkg(name)
-			jsonType = removePkg(name) + "JSON"
+			dartType = dartClassName(name, d, registry, opts)
+			jsonType = dartType + "JSON"
 		}
+	case descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return "", "", "", fmt.Errorf("unsupported type %s, migrate the proto2 group to a nested message and a field of that type", f.GetType())
+	default:
+		return "", "", "", fmt.Errorf("unsupported type %s", f.GetType())
 	}
 	internalType = dartType
 
@@ -462,81 +2836,775 @@ func protoToDartType(f *descriptor.FieldDescriptorProto) (string, string, string
 		jsonType = jsonType + "[]"
 	}
 
-	return dartType, internalType, jsonType
+	return dartType, internalType, jsonType, nil
+}
+
+// UsesJSON reports whether the method is called with the JSON encoding by a
+// client defaulting to JSON if json is set. List outputs and the encoding
+// option override the default.
+func (m ServiceMethod) UsesJSON(json bool) bool {
+	if m.ListOutput {
+		return true
+	}
+
+	switch m.Encoding {
+	case "json":
+		return true
+	case "protobuf":
+		return false
+	}
+	return json
+}
+
+// ConstPrefix is the lowerCamelCase service name prefixing its constants.
+func (s *Service) ConstPrefix() string {
+	return strings.ToLower(s.Name[:1]) + s.Name[1:]
+}
+
+// HasPositional reports whether a method of the service has a
+// <method>With shorthand.
+func (s *Service) HasPositional() bool {
+	for _, m := range s.Methods {
+		if len(m.PositionalFields) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthMethod returns the method named by the health_method option, nil
+// when the service has none.
+func (s *Service) HealthMethod() *ServiceMethod {
+	for i := range s.Methods {
+		if s.Methods[i].Health {
+			return &s.Methods[i]
+		}
+	}
+	return nil
+}
+
+// HasExceptions reports whether the file defines the Twirp exceptions: the
+// clients throw them and the TypedException and error_enum exceptions extend
+// TwirpJsonException, a file with only messages needs none of them.
+func (ctx APIContext) HasExceptions() bool {
+	return len(ctx.Services) > 0 || ctx.MetaModel != nil || ctx.ErrorEnum != nil
+}
+
+// HasHealth reports whether a service of the file has a health method.
+func (ctx APIContext) HasHealth() bool {
+	for _, s := range ctx.Services {
+		if s.HealthMethod() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// healthStatus returns the Dart expression reading the status name from the
+// response of a health method: its singular enum or string status field.
+// Outputs defined in other files, or without such a field, give "".
+func healthStatus(output *Model) string {
+	if output == nil {
+		return ""
+	}
+	for _, f := range output.Fields {
+		if f.JSONName != "status" || f.IsRepeated || f.IsMap {
+			continue
+		}
+		switch {
+		case f.IsEnum:
+			return "response." + f.Name + ".name"
+		case f.Type == "String":
+			return "response." + f.Name
+		}
+	}
+	return ""
+}
+
+// HasMethod reports whether the service has a method with the Dart name.
+func (s *Service) HasMethod(name string) bool {
+	for _, m := range s.Methods {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceName returns the Dart name of the service interface. The message
+// classes of the file share its namespace, so a service named like a message
+// or enum gets a Service suffix.
+func serviceName(name string, ctx APIContext) (string, error) {
+	taken := func(n string) bool {
+		if _, ok := ctx.modelLookup[n]; ok {
+			return true
+		}
+		for _, e := range ctx.Enums {
+			if e.Name == n {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !taken(name) {
+		return name, nil
+	}
+	if !taken(name + "Service") {
+		return name + "Service", nil
+	}
+
+	return "", fmt.Errorf("service %s: the name collides with a message or enum, and so does %sService", name, name)
+}
+
+// methodOrigin describes where the method mi of the service si is declared,
+// e.g. "service.proto:12: Haberdasher.MakeHat". The line is only known when
+// protoc passes the source code info.
+func methodOrigin(d *descriptor.FileDescriptorProto, si, mi int) string {
+	s := d.GetService()[si]
+	file := d.GetName()
+
+	// 6 is the service field of FileDescriptorProto, 2 the method field of
+	// ServiceDescriptorProto.
+	path := []int32{6, int32(si), 2, int32(mi)}
+	for _, loc := range d.GetSourceCodeInfo().GetLocation() {
+		if len(loc.GetSpan()) > 0 && equalPath(loc.GetPath(), path) {
+			file = fmt.Sprintf("%s:%d", file, loc.GetSpan()[0]+1)
+			break
+		}
+	}
+
+	return fmt.Sprintf("%s: %s.%s", file, s.GetName(), s.GetMethod()[mi].GetName())
+}
+
+func equalPath(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dict builds a map from key value pairs, to pass several values to a
+// nested template.
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict: odd number of arguments")
+	}
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is not a string", pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// rpcPath returns the method segment of the request path for an rpc.
+func rpcPath(name string, opts Options) string {
+	if opts.MethodPath == "camel" {
+		return generator.CamelCase(name)
+	}
+
+	return name
+}
+
+// reservedArgNames are Dart keywords and the members and locals of the generated
+// client methods, which a method parameter must not shadow.
+var reservedArgNames = map[string]bool{
+	"assert": true, "break": true, "case": true, "catch": true, "class": true,
+	"const": true, "continue": true, "default": true, "do": true, "else": true,
+	"enum": true, "extends": true, "false": true, "final": true, "finally": true,
+	"for": true, "if": true, "in": true, "is": true, "new": true, "null": true,
+	"rethrow": true, "return": true, "super": true, "switch": true, "this": true,
+	"throw": true, "true": true, "try": true, "var": true, "void": true,
+	"while": true, "with": true,
+
+	"url": true, "uri": true, "body": true, "headers": true, "response": true, "tmp": true,
+	"hostname": true, "client": true, "userAgent": true, "prettyPrint": true, "errorDecoder": true, "headerProvider": true, "close": true,
+	"encodeJson": true, "codec": true, "twirpException": true, "maxRetries": true, "attempt": true,
+	"timeout": true, "lastRequestId": true, "followRedirects": true,
+	// dart:convert top-level names used in the method bodies
+	"utf8": true,
+}
+
+// argName derives the method parameter name from the input type name.
+func argName(inputType string) string {
+	arg := strings.ToLower(inputType[0:1]) + inputType[1:]
+	if reservedArgNames[arg] {
+		arg += "Request"
+	}
+
+	return arg
 }
 
 func isRepeated(field *descriptor.FieldDescriptorProto) bool {
 	return field.Label != nil && *field.Label == descriptor.FieldDescriptorProto_LABEL_REPEATED
 }
 
+func is64Bit(f *descriptor.FieldDescriptorProto) bool {
+	switch f.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64,
+		descriptor.FieldDescriptorProto_TYPE_INT64,
+		descriptor.FieldDescriptorProto_TYPE_UINT64,
+		descriptor.FieldDescriptorProto_TYPE_SINT64:
+		return true
+	}
+	return false
+}
+
+// dartTypeName returns the Dart name of a fully qualified message or enum,
+// with the type_prefix option applied.
+func dartTypeName(typeName string, opts Options) string {
+	return opts.TypePrefix + removePkg(typeName)
+}
+
+// dartClassName returns the class protoc-gen-dart generates for the message
+// or enum typeName, nested types are joined to their parents with
+// underscores, e.g. Hat_Inner for .example.Hat.Inner. Without a registry the
+// types of d still resolve, as for hand built descriptors.
+func dartClassName(typeName string, d *descriptor.FileDescriptorProto, registry *Registry, opts Options) string {
+	class, ok := registry.ClassOf(typeName)
+	if !ok {
+		class, ok = NewRegistry([]*descriptor.FileDescriptorProto{d}).ClassOf(typeName)
+	}
+	if ok {
+		return opts.TypePrefix + class
+	}
+
+	return dartTypeName(typeName, opts)
+}
+
 func removePkg(s string) string {
 	p := strings.Split(s, ".")
 	return p[len(p)-1]
 }
 
+// camelCase returns the Dart accessor name protoc-gen-dart generates for a
+// proto field: every underscore separated part is capitalized with the rest
+// of it kept as is, then the first letter is lowercased. So user_id becomes
+// userId but userID and http_URL keep their acronyms as userID and httpURL.
 func camelCase(s string) string {
 	parts := strings.Split(s, "_")
 
 	for i, p := range parts {
-		if i == 0 {
-			parts[i] = p
-		} else {
-			parts[i] = strings.ToUpper(p[0:1]) + strings.ToLower(p[1:])
+		if p != "" {
+			parts[i] = strings.ToUpper(p[0:1]) + p[1:]
 		}
 	}
 
-	return strings.Join(parts, "")
+	name := strings.Join(parts, "")
+	if name == "" {
+		return name
+	}
+	return strings.ToLower(name[0:1]) + name[1:]
 }
 
 func stringify(f ModelField) string {
-	if f.IsRepeated {
-		singularType := f.Type[0 : len(f.Type)-2] // strip array brackets from type
+	if f.IsMap {
+		return fmt.Sprintf("m.%s.map((k, v) => MapEntry(%s, %s))", f.Name, stringifyMapKey(*f.MapKeyField, "k"), stringifyValue(*f.MapValueField, "v"))
+	}
 
-		if f.Type == "Date" {
-			return fmt.Sprintf("m.%s.map((n) => n.toISOString())", f.Name)
+	if f.IsRepeated {
+		if f.IsTimestamp {
+			return fmt.Sprintf("m.%s.map((n) => %s).toList()", f.Name, stringifyValue(f, "n"))
 		}
 
 		if f.IsMessage {
-			return fmt.Sprintf("m.%s.map(%sToJSON)", f.Name, singularType)
+			return fmt.Sprintf("m.%s.map(%sToJSON).toList()", f.Name, f.InternalType)
+		}
+
+		if f.IsBytes {
+			return fmt.Sprintf("m.%s.map(base64Encode).toList()", f.Name)
+		}
+
+		if f.IsFieldMask {
+			return fmt.Sprintf("m.%s.map((n) => n.join(',')).toList()", f.Name)
+		}
+
+		if f.Is64Bit && !f.IsJSString {
+			return fmt.Sprintf("m.%s.map((n) => %s).toList()", f.Name, stringifyValue(f, "n"))
+		}
+
+		if f.IsEnum {
+			return fmt.Sprintf("m.%s.map(%sToJSON).toList()", f.Name, f.InternalType)
 		}
+
+		// lists of scalars are already valid JSON values
+		return "m." + f.Name
+	}
+
+	return stringifyValue(f, "m."+f.Name)
+}
+
+// stringifyValue converts the singular Dart value of f to its JSON value.
+func stringifyValue(f ModelField, value string) string {
+	// google.protobuf.Value is already a JSON value
+	if f.IsValue {
+		return value
 	}
 
-	if f.Type == "Date" {
-		return fmt.Sprintf("m.%s.toISOString()", f.Name)
+	// RFC 3339 wants the Z suffix, a local DateTime would have no offset
+	if f.IsTimestamp {
+		return fmt.Sprintf("%s.toUtc().toIso8601String()", value)
 	}
 
 	if f.IsMessage {
-		return fmt.Sprintf("%sToJSON(m.%s)", f.Type, f.Name)
+		return fmt.Sprintf("%sToJSON(%s)", f.Type, value)
+	}
+
+	if f.IsBytes {
+		return fmt.Sprintf("base64Encode(%s)", value)
+	}
+
+	if f.IsFieldMask {
+		return fmt.Sprintf("%s.join(',')", value)
+	}
+
+	if f.IsEnum {
+		return fmt.Sprintf("%sToJSON(%s)", f.Type, value)
 	}
 
-	return "m." + f.Name
+	// proto3 JSON encodes 64-bit integers as decimal strings
+	if f.Is64Bit && !f.IsJSString {
+		return fmt.Sprintf("%s.toString()", value)
+	}
+
+	return value
 }
 
-func parse(f ModelField, modelName string) string {
-	field := "(((m as " + modelName + ")." + f.Name + ") ? (m as " + modelName + ")." + f.Name + " : (m as " + modelName + "JSON)." + f.JSONName + ")"
-	if strings.Compare(f.Name, f.JSONName) == 0 {
-		field = "m." + f.Name
+// stringifyMapKey converts a map key to a string, proto3 JSON objects only
+// have string keys even for integer and bool keyed maps.
+func stringifyMapKey(f ModelField, key string) string {
+	if f.Type == "String" {
+		return key
 	}
 
-	if f.IsRepeated {
-		singularType := f.Type[0 : len(f.Type)-2] // strip array brackets from type
+	return key + ".toString()"
+}
+
+// pureField declares f in a pure model class, initialized to its proto3
+// default. Singular messages, and bytes with presence, are null when not set.
+func pureField(f ModelField) string {
+	switch {
+	case f.IsMap:
+		return fmt.Sprintf("%s %s = {}", f.Type, f.Name)
+	case f.IsRepeated:
+		return fmt.Sprintf("%s %s = []", f.Type, f.Name)
+	case f.IsMessage, f.IsBytes && f.HasPresence:
+		return fmt.Sprintf("%s? %s", f.Type, f.Name)
+	case f.IsBytes:
+		return fmt.Sprintf("Uint8List %s = Uint8List(0)", f.Name)
+	case f.IsEnum:
+		return fmt.Sprintf("%s %s = %s.values.first", f.Type, f.Name, f.Type)
+	}
+
+	return fmt.Sprintf("%s %s = %s", f.Type, f.Name, defaultValue(f))
+}
 
-		if f.Type == "Date" {
-			return fmt.Sprintf("%s.map((n) => Date(n))", field)
+// pureToJSON returns the map literal entry encoding f of the pure model m,
+// singular messages and bytes with presence are left out when not set.
+func pureToJSON(f ModelField) string {
+	if (f.IsMessage || f.IsBytes && f.HasPresence) && !f.IsRepeated {
+		return fmt.Sprintf("if (m.%s != null) '%s': %s", f.Name, f.JSONName, stringifyValue(f, "m."+f.Name+"!"))
+	}
+
+	return fmt.Sprintf("'%s': %s", f.JSONName, stringify(f))
+}
+
+// applyFreezed fills in the fields of the @freezed copies of the models. The
+// copies refer to each other, so message fields must have a top-level
+// message of the file or google.protobuf.Timestamp as their type.
+func (ctx *APIContext) applyFreezed(d *descriptor.FileDescriptorProto) error {
+	ctx.FreezedFile = strings.TrimSuffix(path.Base(dartModuleFilename(d)), ".dart")
+
+	enums := map[string]bool{}
+	for _, m := range ctx.Models {
+		for _, f := range m.Fields {
+			field, err := ctx.freezedField(f, enums)
+			if err != nil {
+				return fmt.Errorf("%s: use_freezed: field %s of %s %v", d.GetName(), f.Name, m.Name, err)
+			}
+			m.Freezed = append(m.Freezed, field)
+		}
+	}
+
+	for name := range enums {
+		ctx.FreezedEnums = append(ctx.FreezedEnums, name)
+	}
+	sort.Strings(ctx.FreezedEnums)
+
+	return nil
+}
+
+// freezedField returns the @freezed copy of f, adding the enums it uses to
+// enums.
+func (ctx *APIContext) freezedField(f ModelField, enums map[string]bool) (FreezedField, error) {
+	field := FreezedField{Name: f.Name}
+
+	if f.IsFieldMask {
+		if f.IsRepeated {
+			return field, fmt.Errorf("is a repeated google.protobuf.FieldMask, which is not supported")
+		}
+		field.Decl = fmt.Sprintf("@Default(<String>[]) List<String> %s", f.Name)
+		field.ToFreezed = fmt.Sprintf("List.of(%s.paths)", f.Name)
+		field.ToProto = fmt.Sprintf("$message.%s = FieldMask(paths: %s);", f.Name, f.Name)
+		return field, nil
+	}
+
+	switch {
+	case f.IsMap:
+		key, err := ctx.freezedElement(*f.MapKeyField, f.MapKeyField.Type, enums)
+		if err != nil {
+			return field, err
+		}
+		value, err := ctx.freezedElement(*f.MapValueField, f.MapValueField.Type, enums)
+		if err != nil {
+			return field, err
+		}
+		t := fmt.Sprintf("Map<%s, %s>", key.typ, value.typ)
+		field.Decl = fmt.Sprintf("%s@Default(<%s, %s>{}) %s %s", value.annotation, key.typ, value.typ, t, f.Name)
+		if key.toFreezed == "" && value.toFreezed == "" {
+			field.ToFreezed = fmt.Sprintf("Map.of(%s)", f.Name)
+			field.ToProto = fmt.Sprintf("$message.%s.addAll(%s);", f.Name, f.Name)
+		} else {
+			field.ToFreezed = fmt.Sprintf("%s.map((k, v) => MapEntry(%s, %s))", f.Name, key.convert(key.toFreezed, "k"), value.convert(value.toFreezed, "v"))
+			field.ToProto = fmt.Sprintf("$message.%s.addAll(%s.map((k, v) => MapEntry(%s, %s)));", f.Name, f.Name, key.convert(key.toProto, "k"), value.convert(value.toProto, "v"))
+		}
+
+	case f.IsRepeated:
+		elem, err := ctx.freezedElement(f, f.InternalType, enums)
+		if err != nil {
+			return field, err
+		}
+		field.Decl = fmt.Sprintf("%s@Default(<%s>[]) List<%s> %s", elem.annotation, elem.typ, elem.typ, f.Name)
+		if elem.toFreezed == "" {
+			field.ToFreezed = fmt.Sprintf("List.of(%s)", f.Name)
+			field.ToProto = fmt.Sprintf("$message.%s.addAll(%s);", f.Name, f.Name)
+		} else {
+			field.ToFreezed = fmt.Sprintf("%s.map((e) => %s).toList()", f.Name, fmt.Sprintf(elem.toFreezed, "e"))
+			field.ToProto = fmt.Sprintf("$message.%s.addAll(%s.map((e) => %s));", f.Name, f.Name, fmt.Sprintf(elem.toProto, "e"))
+		}
+
+	default:
+		elem, err := ctx.freezedElement(f, f.Type, enums)
+		if err != nil {
+			return field, err
+		}
+		switch {
+		case f.IsMessage:
+			// unset messages are null in the copy
+			field.Decl = fmt.Sprintf("%s? %s", elem.typ, f.Name)
+			field.ToFreezed = fmt.Sprintf("has%s() ? %s : null", f.CaseName, fmt.Sprintf(elem.toFreezed, f.Name))
+			field.ToProto = fmt.Sprintf("if (%s != null) {\n\t\t\t$message.%s = %s;\n\t\t}", f.Name, f.Name, fmt.Sprintf(elem.toProto, f.Name+"!"))
+		case f.IsEnum:
+			field.Decl = fmt.Sprintf("%s%s? %s", elem.annotation, elem.typ, f.Name)
+			field.ToFreezed = f.Name
+			field.ToProto = fmt.Sprintf("if (%s != null) {\n\t\t\t$message.%s = %s!;\n\t\t}", f.Name, f.Name, f.Name)
+		case f.IsBytes:
+			field.Decl = fmt.Sprintf("%s@Default(<int>[]) List<int> %s", elem.annotation, f.Name)
+			field.ToFreezed = fmt.Sprintf("List.of(%s)", f.Name)
+			field.ToProto = fmt.Sprintf("$message.%s = %s;", f.Name, f.Name)
+		default:
+			field.Decl = fmt.Sprintf("@Default(%s) %s %s", defaultValue(f), elem.typ, f.Name)
+			field.ToFreezed = elem.convert(elem.toFreezed, f.Name)
+			field.ToProto = fmt.Sprintf("$message.%s = %s;", f.Name, elem.convert(elem.toProto, f.Name))
+		}
+	}
+
+	return field, nil
+}
+
+// freezedElement describes a single value of a freezed field: its Dart type,
+// the annotation encoding it in JSON and the conversions of a value %s from
+// the message and back, empty when the value is kept as is.
+type freezedElement struct {
+	typ        string
+	annotation string
+	toFreezed  string
+	toProto    string
+}
+
+// convert applies the conversion format, toFreezed or toProto, to value.
+func (e freezedElement) convert(format, value string) string {
+	if format == "" {
+		return value
+	}
+	return fmt.Sprintf(format, value)
+}
+
+// freezedElement returns the freezed element of the values of f, whose Dart
+// type is dartType.
+func (ctx *APIContext) freezedElement(f ModelField, dartType string, enums map[string]bool) (freezedElement, error) {
+	switch {
+	case f.IsValue:
+		return freezedElement{}, fmt.Errorf("has the type google.protobuf.Value, which is not supported")
+	case f.IsTimestamp:
+		return freezedElement{typ: "DateTime", toFreezed: "%s.toDateTime()", toProto: "Timestamp.fromDateTime(%s)"}, nil
+	case f.IsMessage:
+		if m, ok := ctx.modelLookup[dartType]; !ok || m.Primitive {
+			return freezedElement{}, fmt.Errorf("has the type %s, freezed copies only refer to the top-level messages of the file", dartType)
+		}
+		return freezedElement{typ: dartType + "Data", toFreezed: "%s.toFreezed()", toProto: "%s.toProto()"}, nil
+	case f.IsEnum:
+		enums[dartType] = true
+		return freezedElement{typ: dartType, annotation: "@_" + dartType + "Converter() "}, nil
+	case f.IsBytes:
+		ctx.FreezedBytes = true
+		return freezedElement{typ: "List<int>", annotation: "@_TwirpBytesConverter() "}, nil
+	case f.IsJSString:
+		return freezedElement{typ: dartType, toFreezed: "%s.toString()", toProto: "Int64.parseInt(%s)"}, nil
+	case f.Is64Bit:
+		// the copies keep the int of the models, the messages hold Int64
+		return freezedElement{typ: dartType, toFreezed: "%s.toInt()", toProto: "Int64(%s)"}, nil
+	}
+
+	return freezedElement{typ: dartType}, nil
+}
+
+// usesTimestamp reports whether a model has a google.protobuf.Timestamp
+// field or map value.
+func (ctx APIContext) usesTimestamp() bool {
+	for _, m := range ctx.Models {
+		for _, f := range m.Fields {
+			if f.IsMap {
+				f = *f.MapValueField
+			}
+			if f.IsTimestamp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// uses64Bit reports whether a model has a 64-bit integer field, map key or
+// map value.
+func (ctx APIContext) uses64Bit() bool {
+	for _, m := range ctx.Models {
+		for _, f := range m.Fields {
+			if f.Is64Bit || (f.IsMap && (f.MapKeyField.Is64Bit || f.MapValueField.Is64Bit)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protoValue converts the Dart value of the singular field f to the type
+// of the protoc-gen-dart message field: Int64 for 64-bit integers,
+// Timestamp for DateTime and FieldMask for its paths.
+func protoValue(f ModelField, value string) string {
+	switch {
+	case f.IsJSString:
+		return fmt.Sprintf("Int64.parseInt(%s)", value)
+	case f.Is64Bit:
+		return fmt.Sprintf("Int64(%s)", value)
+	case f.IsTimestamp:
+		return fmt.Sprintf("Timestamp.fromDateTime(%s)", value)
+	case f.IsFieldMask:
+		return fmt.Sprintf("FieldMask(paths: %s)", value)
+	}
+	return value
+}
+
+// dartValue converts the protoc-gen-dart value of the singular field f back
+// to its Dart type, the inverse of protoValue.
+func dartValue(f ModelField, value string) string {
+	switch {
+	case f.IsJSString:
+		return fmt.Sprintf("%s.toString()", value)
+	case f.Is64Bit:
+		return fmt.Sprintf("%s.toInt()", value)
+	case f.IsTimestamp:
+		return fmt.Sprintf("%s.toDateTime()", value)
+	case f.IsFieldMask:
+		return fmt.Sprintf("%s.paths", value)
+	}
+	return value
+}
+
+// protoValues converts the Dart list or map of the repeated field f element
+// by element, the way protoValue converts a singular value.
+func protoValues(f ModelField, value string) string {
+	if f.IsMap {
+		key, val := protoValue(*f.MapKeyField, "k"), protoValue(*f.MapValueField, "v")
+		if key == "k" && val == "v" {
+			return value
+		}
+		return fmt.Sprintf("%s.map((k, v) => MapEntry(%s, %s))", value, key, val)
+	}
+	if elem := protoValue(f, "v"); elem != "v" {
+		return fmt.Sprintf("%s.map((v) => %s)", value, elem)
+	}
+	return value
+}
+
+// queryFields returns the fields of m a query helper encodes: the singular
+// fields that aren't messages or bytes.
+func queryFields(m *Model) []ModelField {
+	var fields []ModelField
+	for _, f := range m.Fields {
+		if f.IsMap || f.IsRepeated || f.IsMessage || f.IsBytes || f.IsFieldMask || f.IsValue {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// queryValue returns the query parameter value of the field f of arg,
+// enums are encoded by name like in proto3 JSON.
+func queryValue(arg string, f ModelField) string {
+	switch {
+	case f.IsEnum:
+		return fmt.Sprintf("%s.%s.name", arg, f.Name)
+	case f.Type == "String" && !f.IsJSString:
+		return fmt.Sprintf("%s.%s", arg, f.Name)
+	}
+	// the Int64 of a JS_STRING field is interpolated like the other numbers
+	return fmt.Sprintf("'${%s.%s}'", arg, f.Name)
+}
+
+// defaultValue returns the Dart literal for the proto3 default value of a field.
+func defaultValue(f ModelField) string {
+	if f.IsMap {
+		return "const {}"
+	}
+
+	if f.IsRepeated || f.IsFieldMask {
+		return "const []"
+	}
+
+	switch f.Type {
+	case "int":
+		return "0"
+	case "double":
+		return "0.0"
+	case "bool":
+		return "false"
+	case "String":
+		return "''"
+	}
+
+	return "null"
+}
+
+func parse(f ModelField) string {
+	field := fmt.Sprintf("m['%s']", f.JSONName)
+
+	if f.IsMap {
+		return fmt.Sprintf("(%s as Map<String, dynamic>).map((k, v) => MapEntry(%s, %s))", field, parseMapKey(*f.MapKeyField, "k"), parseValue(*f.MapValueField, "v"))
+	}
+
+	if f.IsRepeated {
+		if f.IsTimestamp {
+			return fmt.Sprintf("(%s as List).map((n) => DateTime.parse(n as String)).toList()", field)
 		}
 
 		if f.IsMessage {
-			return fmt.Sprintf("%s.map(JSONTo%s)", field, singularType)
+			return fmt.Sprintf("(%s as List).map((n) => JSONTo%s(n as Map<String, dynamic>)).toList()", field, f.InternalType)
+		}
+
+		if f.IsBytes {
+			return fmt.Sprintf("(%s as List).map((n) => base64Decode(n as String)).toList()", field)
+		}
+
+		if f.IsFieldMask {
+			return fmt.Sprintf("(%s as List).map((n) => %s).toList()", field, parseFieldMask("n"))
+		}
+
+		if f.IsEnum {
+			return fmt.Sprintf("(%s as List).map(JSONTo%s).toList()", field, f.InternalType)
+		}
+
+		if f.InternalType == "double" {
+			return fmt.Sprintf("(%s as List).map((n) => %s).toList()", field, parseScalar("n", f.InternalType))
+		}
+
+		if f.IsJSString {
+			return fmt.Sprintf("(%s as List).map((n) => n.toString()).toList()", field)
+		}
+
+		if f.Is64Bit {
+			return fmt.Sprintf("(%s as List).map((n) => %s).toList()", field, parseValue(f, "n"))
 		}
+
+		return fmt.Sprintf("List<%s>.from(%s as List)", f.InternalType, field)
 	}
 
-	if f.Type == "Date" {
-		return fmt.Sprintf("Date(%s)", field)
+	return parseValue(f, field)
+}
+
+// parseValue converts the decoded JSON value to the singular Dart value of f.
+func parseValue(f ModelField, value string) string {
+	if f.IsValue {
+		return value
+	}
+
+	if f.IsTimestamp {
+		return fmt.Sprintf("DateTime.parse(%s as String)", value)
 	}
 
 	if f.IsMessage {
-		return fmt.Sprintf("JSONTo%s(%s)", f.Type, field)
+		return fmt.Sprintf("JSONTo%s(%s as Map<String, dynamic>)", f.Type, value)
+	}
+
+	if f.IsBytes {
+		return fmt.Sprintf("base64Decode(%s as String)", value)
+	}
+
+	if f.IsFieldMask {
+		return parseFieldMask(value)
+	}
+
+	if f.IsJSString {
+		return fmt.Sprintf("%s.toString()", value)
+	}
+
+	// a decimal string, or a number from lenient encoders
+	if f.Is64Bit {
+		return fmt.Sprintf("int.parse(%s.toString())", value)
+	}
+
+	if f.IsEnum {
+		return fmt.Sprintf("JSONTo%s(%s)", f.Type, value)
+	}
+
+	return parseScalar(value, f.Type)
+}
+
+// parseFieldMask splits the comma joined paths of a FieldMask, the empty
+// string being the empty mask.
+func parseFieldMask(value string) string {
+	return fmt.Sprintf("(%s as String).split(',').where((p) => p.isNotEmpty).toList()", value)
+}
+
+// parseMapKey converts a JSON object key back to the Dart map key type.
+func parseMapKey(f ModelField, key string) string {
+	switch f.Type {
+	case "int":
+		return fmt.Sprintf("int.parse(%s)", key)
+	case "bool":
+		return fmt.Sprintf("%s == 'true'", key)
+	}
+
+	return key
+}
+
+// parseScalar casts a decoded JSON value to the Dart scalar type. JSON numbers
+// without a fraction decode as int, so doubles are converted through num.
+func parseScalar(value, dartType string) string {
+	if dartType == "double" {
+		return fmt.Sprintf("(%s as num).toDouble()", value)
 	}
 
-	return field
+	return fmt.Sprintf("%s as %s", value, dartType)
 }
@@ -1,6 +1,16 @@
 package generator
 
-import "testing"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/gogo/protobuf/protoc-gen-gogo/generator"
+	"github.com/gogo/protobuf/protoc-gen-gogo/plugin"
+)
 
 func TestAPIContext_ApplyMarshalFlags(t *testing.T) {
 	nested := &Model{
@@ -54,3 +64,3264 @@ func TestAPIContext_ApplyMarshalFlags(t *testing.T) {
 		t.Errorf("expected nested.CanMarshal to be true since it is a field in Bar")
 	}
 }
+
+// largeAPIContext has n models and a service with n/2 methods, each taking
+// one model and returning the next.
+func largeAPIContext(n int) APIContext {
+	ctx := NewAPIContext()
+	s := &Service{Name: "Large"}
+	for i := 0; i < n; i++ {
+		ctx.AddModel(&Model{Name: fmt.Sprintf("M%d", i)})
+		if i%2 == 1 {
+			s.Methods = append(s.Methods, ServiceMethod{
+				Name:       fmt.Sprintf("call%d", i),
+				InputType:  fmt.Sprintf("M%d", i-1),
+				OutputType: fmt.Sprintf("M%d", i),
+			})
+		}
+	}
+	// a model used as both the input and the output of a method
+	s.Methods = append(s.Methods, ServiceMethod{Name: "echo", InputType: "M1", OutputType: "M1"})
+	ctx.Services = append(ctx.Services, s)
+	return ctx
+}
+
+func TestAPIContext_MarkRPCModels(t *testing.T) {
+	ctx := largeAPIContext(100)
+	ctx.markRPCModels()
+
+	// the flags of the nested loop markRPCModels replaces
+	for _, m := range ctx.Models {
+		var marshal, unmarshal bool
+		for _, s := range ctx.Services {
+			for _, sm := range s.Methods {
+				marshal = marshal || m.Name == sm.InputType
+				unmarshal = unmarshal || m.Name == sm.OutputType
+			}
+		}
+		if m.CanMarshal != marshal || m.CanUnmarshal != unmarshal {
+			t.Errorf("%s: got CanMarshal=%v CanUnmarshal=%v, expected %v %v", m.Name, m.CanMarshal, m.CanUnmarshal, marshal, unmarshal)
+		}
+	}
+	if m1 := ctx.modelLookup["M1"]; !m1.CanMarshal || !m1.CanUnmarshal {
+		t.Errorf("expected M1 to be marshalled and unmarshalled")
+	}
+}
+
+func BenchmarkAPIContext_MarkRPCModels(b *testing.B) {
+	ctx := largeAPIContext(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.markRPCModels()
+	}
+}
+
+func generateClient(t *testing.T, d *descriptor.FileDescriptorProto, params map[string]string) string {
+	t.Helper()
+
+	opts, err := NewOptions(params)
+	if err != nil {
+		t.Fatalf("NewOptions returned an error: %v", err)
+	}
+
+	files, err := CreateClientAPI(d, nil, nil, opts)
+	if err != nil {
+		t.Fatalf("CreateClientAPI returned an error: %v", err)
+	}
+
+	return files[0].GetContent()
+}
+
+func generateFiles(t *testing.T, d *descriptor.FileDescriptorProto, params map[string]string) map[string]string {
+	t.Helper()
+
+	opts, err := NewOptions(params)
+	if err != nil {
+		t.Fatalf("NewOptions returned an error: %v", err)
+	}
+
+	files, err := CreateClientAPI(d, nil, nil, opts)
+	if err != nil {
+		t.Fatalf("CreateClientAPI returned an error: %v", err)
+	}
+
+	contents := make(map[string]string)
+	for _, f := range files {
+		contents[f.GetName()] = f.GetContent()
+	}
+
+	return contents
+}
+
+func TestCreateClientAPI_EmptyService(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("empty.proto"),
+		Package: proto.String("empty"),
+		Service: []*descriptor.ServiceDescriptorProto{
+			{Name: proto.String("Nothing")},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+
+	for _, class := range []string{
+		"abstract class Nothing {",
+		"class TwirpJsonNothing extends _TwirpNothingBase implements Nothing {",
+		"class TwirpProtobufNothing extends _TwirpNothingBase implements Nothing {",
+	} {
+		if !strings.Contains(out, class) {
+			t.Errorf("expected output to contain %q", class)
+		}
+	}
+
+	clients := out[strings.Index(out, "class TwirpJsonNothing"):]
+	if strings.Count(clients, "@override") != strings.Count(clients, "void close() {") {
+		t.Errorf("expected no @override annotations besides close() for a service without methods")
+	}
+}
+
+func TestNewField_JSONName(t *testing.T) {
+	m := &descriptor.DescriptorProto{Name: proto.String("User")}
+	d := &descriptor.FileDescriptorProto{Name: proto.String("user.proto")}
+	f := &descriptor.FieldDescriptorProto{
+		Name:     proto.String("display_name"),
+		JsonName: proto.String("screenName"),
+		Type:     descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+	}
+
+	field := mustNewField(t, f, m, d, nil, Options{})
+	if field.JSONName != "screenName" {
+		t.Errorf("expected json_name override screenName, got %s", field.JSONName)
+	}
+	if field.Name != "displayName" {
+		t.Errorf("expected Dart field name displayName, got %s", field.Name)
+	}
+
+	field = mustNewField(t, f, m, d, nil, Options{UseProtoNames: true})
+	if field.JSONName != "display_name" {
+		t.Errorf("expected original proto name display_name, got %s", field.JSONName)
+	}
+}
+
+// withoutHeader strips the generated file header comment from out.
+func withoutHeader(out string) string {
+	for strings.HasPrefix(out, "// ") {
+		out = out[strings.Index(out, "\n")+1:]
+	}
+	return out
+}
+
+func scalarField(name string, number int32, typ descriptor.FieldDescriptorProto_Type) *descriptor.FieldDescriptorProto {
+	return &descriptor.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Type:   typ.Enum(),
+		Label:  descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+}
+
+func repeatedField(name string, number int32, typ descriptor.FieldDescriptorProto_Type) *descriptor.FieldDescriptorProto {
+	f := scalarField(name, number, typ)
+	f.Label = descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	return f
+}
+
+func messageField(name string, number int32, typeName string) *descriptor.FieldDescriptorProto {
+	f := scalarField(name, number, descriptor.FieldDescriptorProto_TYPE_MESSAGE)
+	f.TypeName = proto.String(typeName)
+	return f
+}
+
+func enumField(name string, number int32, typeName string) *descriptor.FieldDescriptorProto {
+	f := scalarField(name, number, descriptor.FieldDescriptorProto_TYPE_ENUM)
+	f.TypeName = proto.String(typeName)
+	return f
+}
+
+func haberdasherFile() *descriptor.FileDescriptorProto {
+	return &descriptor.FileDescriptorProto{
+		Name:    proto.String("haberdasher.proto"),
+		Package: proto.String("example"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Size"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("inches", 1, descriptor.FieldDescriptorProto_TYPE_INT32),
+				},
+			},
+			{
+				Name: proto.String("Hat"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("color", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+					repeatedField("tags", 2, descriptor.FieldDescriptorProto_TYPE_STRING),
+				},
+			},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("Haberdasher"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("MakeHat"),
+						InputType:  proto.String(".example.Size"),
+						OutputType: proto.String(".example.Hat"),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestCreateClientAPI_ModelDebugString(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"extension HatDebug on Hat {",
+		"return 'Hat{color: $color, tags: ${tags.length} items}';",
+		"return 'Size{inches: $inches}';",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if strings.Contains(out, "on DateTime") {
+		t.Errorf("expected no debug extension for the primitive DateTime model")
+	}
+}
+
+func TestCreateClientAPI_ModelDefaults(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("defaults.proto"),
+		Package: proto.String("defaults"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Scalars"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("count", 1, descriptor.FieldDescriptorProto_TYPE_INT32),
+					scalarField("total", 2, descriptor.FieldDescriptorProto_TYPE_UINT64),
+					scalarField("ratio", 3, descriptor.FieldDescriptorProto_TYPE_DOUBLE),
+					scalarField("weight", 4, descriptor.FieldDescriptorProto_TYPE_FLOAT),
+					scalarField("enabled", 5, descriptor.FieldDescriptorProto_TYPE_BOOL),
+					scalarField("label", 6, descriptor.FieldDescriptorProto_TYPE_STRING),
+					repeatedField("values", 7, descriptor.FieldDescriptorProto_TYPE_SINT32),
+				},
+			},
+			{Name: proto.String("Empty")},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+
+	for _, expected := range []string{
+		"Scalars newScalars({",
+		"int count = 0,",
+		"int total = 0,",
+		"$message.total = Int64(total);",
+		"import 'package:fixnum/fixnum.dart';",
+		"double ratio = 0.0,",
+		"double weight = 0.0,",
+		"bool enabled = false,",
+		"String label = '',",
+		"List<int> values = const [],",
+		"$message.values.addAll(values);",
+		"Empty newEmpty() {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_ModelConversions(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("conversions.proto"),
+		Package: proto.String("conversions"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Event"),
+				Field: []*descriptor.FieldDescriptorProto{
+					messageField("created_at", 1, ".google.protobuf.Timestamp"),
+					repeatedField("ids", 2, descriptor.FieldDescriptorProto_TYPE_INT64),
+					scalarField("count", 3, descriptor.FieldDescriptorProto_TYPE_INT32),
+				},
+			},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+
+	for _, expected := range []string{
+		"$message.createdAt = Timestamp.fromDateTime(createdAt);",
+		"$message.ids.addAll(ids.map((v) => Int64(v)));",
+		"$message.count = count;",
+		"import 'package:fixnum/fixnum.dart';",
+		"import 'package:protobuf/well_known_types/google/protobuf/timestamp.pb.dart';",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	pure := generateClient(t, d, map[string]string{"pure": "true"})
+	if strings.Contains(pure, "Int64(") || strings.Contains(pure, "Timestamp.fromDateTime") {
+		t.Error("pure models should keep the Dart values")
+	}
+}
+
+func TestCreateClientAPI_NestedTypes(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("nested.proto"),
+		Package: proto.String("nested"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Hat"),
+				Field: []*descriptor.FieldDescriptorProto{
+					messageField("inner", 1, ".nested.Hat.Inner"),
+					enumField("kind", 2, ".nested.Hat.Kind"),
+					messageField("deep", 3, ".nested.Hat.Inner.Deep"),
+					scalarField("m", 4, descriptor.FieldDescriptorProto_TYPE_STRING),
+				},
+				NestedType: []*descriptor.DescriptorProto{
+					{
+						Name:       proto.String("Inner"),
+						NestedType: []*descriptor.DescriptorProto{{Name: proto.String("Deep")}},
+					},
+				},
+				EnumType: []*descriptor.EnumDescriptorProto{
+					{
+						Name:  proto.String("Kind"),
+						Value: []*descriptor.EnumValueDescriptorProto{{Name: proto.String("PLAIN"), Number: proto.Int32(0)}},
+					},
+				},
+			},
+		},
+	}
+
+	out := generateClient(t, d, map[string]string{"generate_builders": "true"})
+	for _, expected := range []string{
+		"Hat_Inner? inner,",
+		"Hat_Kind? kind,",
+		"Hat_Inner_Deep? deep,",
+		"String m = '',",
+		"final $message = Hat();",
+		"$message.m = m;",
+		"return $message;",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+
+	// with a registry the nesting is resolved the same way
+	registry := NewRegistry([]*descriptor.FileDescriptorProto{d})
+	if class, ok := registry.ClassOf(".nested.Hat.Inner.Deep"); !ok || class != "Hat_Inner_Deep" {
+		t.Errorf("expected Hat_Inner_Deep, got %q", class)
+	}
+	if class, ok := registry.ClassOf(".nested.Hat.Kind"); !ok || class != "Hat_Kind" {
+		t.Errorf("expected Hat_Kind, got %q", class)
+	}
+}
+
+func TestCreateClientAPI_CrossFileTypes(t *testing.T) {
+	common := &descriptor.FileDescriptorProto{
+		Name:    proto.String("shared/common.proto"),
+		Package: proto.String("shared"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Hat"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("color", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+				},
+			},
+		},
+	}
+	palette := &descriptor.FileDescriptorProto{
+		Name:    proto.String("palette/colors.proto"),
+		Package: proto.String("palette"),
+		EnumType: []*descriptor.EnumDescriptorProto{
+			{
+				Name:  proto.String("Color"),
+				Value: []*descriptor.EnumValueDescriptorProto{{Name: proto.String("RED"), Number: proto.Int32(0)}},
+			},
+		},
+	}
+	service := &descriptor.FileDescriptorProto{
+		Name:       proto.String("api/service.proto"),
+		Package:    proto.String("api"),
+		Dependency: []string{"shared/common.proto", "palette/colors.proto"},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Size"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("inches", 1, descriptor.FieldDescriptorProto_TYPE_INT32),
+					// the only reference to palette/colors.proto
+					enumField("color", 2, ".palette.Color"),
+				},
+			},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("Haberdasher"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("MakeHat"),
+						InputType:  proto.String(".api.Size"),
+						OutputType: proto.String(".shared.Hat"),
+					},
+				},
+			},
+		},
+	}
+
+	registry := NewRegistry([]*descriptor.FileDescriptorProto{common, palette, service})
+	files, err := CreateClientAPI(service, nil, registry, Options{})
+	if err != nil {
+		t.Fatalf("CreateClientAPI returned an error: %v", err)
+	}
+	out := files[0].GetContent()
+
+	if !strings.Contains(out, "import '../shared/common.pb.dart';") {
+		t.Errorf("expected the .pb.dart of the file defining Hat to be imported, got:\n%s", out)
+	}
+	if !strings.Contains(out, "Future<Hat> makeHat(Size size);") {
+		t.Errorf("expected makeHat to return the Hat defined in shared/common.proto")
+	}
+	if !strings.Contains(out, "import '../palette/colors.pb.dart';") || !strings.Contains(out, "Color? color,") {
+		t.Errorf("expected the .pb.dart of the file defining the Color enum to be imported, got:\n%s", out)
+	}
+}
+
+func TestCreateClientAPI_UserAgent(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"final String? userAgent;",
+		"super.userAgent = 'twirp-dart/" + Version + "',",
+		"if (userAgent != null) 'User-Agent': userAgent!,",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_PrettyPrint(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"final bool prettyPrint;",
+		"this.prettyPrint = false",
+		"final body = encodeJson(size.toProto3Json(typeRegistry: typeRegistry));",
+		"return JsonEncoder.withIndent('  ').convert(jsonDecode(codec.encode(value)));",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_ClientFactory(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"enum TwirpFormat { json, protobuf }",
+		"Haberdasher createHaberdasher(String hostname, {TwirpFormat format = TwirpFormat.protobuf, Client? client}) {",
+		"return TwirpJsonHaberdasher(hostname, client: client);",
+		"return TwirpProtobufHaberdasher(hostname, client: client);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_UriFactory(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	for _, expected := range []string{
+		"Uri resolveTwirpUri(Uri base, String path) {",
+		"path: base.path.endsWith('/') ? base.path : '${base.path}/',",
+		"return mount.resolve(path.startsWith('/') ? path.substring(1) : path);",
+		"Haberdasher createHaberdasherFromUri(Uri base, {TwirpFormat format = TwirpFormat.protobuf, Client? client}) {\n" +
+			"  return createHaberdasher(resolveTwirpUri(base, '').toString(), format: format, client: client);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"clients": "json", "default_hostname": "https://hats.example.com"})
+	expected := "Haberdasher createHaberdasherFromUri(Uri base, {Client? client}) {\n" +
+		"  return createHaberdasher(hostname: resolveTwirpUri(base, '').toString(), client: client);"
+	if !strings.Contains(out, expected) {
+		t.Errorf("expected output to contain %q", expected)
+	}
+}
+
+func TestCreateClientAPI_PlatformClient(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"///     export 'http_client_io.dart'\n///         if (dart.library.js_interop) 'http_client_web.dart';",
+		"///     final service = createHaberdasher(hostname, client: createHttpClient());\n///\n/// Without [client] the default [Client] of package:http is used.\nHaberdasher createHaberdasher(",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	for _, platform := range []string{"package:http/io_client.dart", "package:http/browser_client.dart", "dart:io", "dart:html"} {
+		if strings.Contains(out, "import '"+platform+"';") {
+			t.Errorf("expected no platform specific import of %s", platform)
+		}
+	}
+}
+
+func TestCreateClientAPI_ImportPrefix(t *testing.T) {
+	d := haberdasherFile()
+	d.Name = proto.String("example/haberdasher.proto")
+	d.Dependency = []string{"example/common.proto"}
+
+	out := generateClient(t, d, map[string]string{"import_prefix": "package:my_pkg"})
+
+	for _, expected := range []string{
+		"import 'package:my_pkg/example/haberdasher.pb.dart';",
+		"import 'package:my_pkg/example/common.twirp.dart';",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_PbImportTrimsSuffixOnly(t *testing.T) {
+	d := haberdasherFile()
+	d.Name = proto.String("my.proto.defs.proto")
+
+	out := generateClient(t, d, nil)
+	if !strings.Contains(out, "import 'my.proto.defs.pb.dart';") {
+		t.Errorf("expected only the trailing .proto to be trimmed, got:\n%s", out)
+	}
+}
+
+func TestStringifyParse_DateTime(t *testing.T) {
+	m := &descriptor.DescriptorProto{Name: proto.String("Event")}
+	d := &descriptor.FileDescriptorProto{Name: proto.String("event.proto")}
+
+	single := mustNewField(t, messageField("created_at", 1, ".google.protobuf.Timestamp"), m, d, nil, Options{})
+	repeated := messageField("seen_at", 2, ".google.protobuf.Timestamp")
+	repeated.Label = descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	list := mustNewField(t, repeated, m, d, nil, Options{})
+
+	tests := []struct {
+		actual, expected string
+	}{
+		{stringify(single), "m.createdAt.toUtc().toIso8601String()"},
+		{parse(single), "DateTime.parse(m['created_at'] as String)"},
+		{stringify(list), "m.seenAt.map((n) => n.toUtc().toIso8601String()).toList()"},
+		{parse(list), "(m['seen_at'] as List).map((n) => DateTime.parse(n as String)).toList()"},
+	}
+
+	for _, tt := range tests {
+		if tt.actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, tt.actual)
+		}
+		if strings.Contains(tt.actual, "toISOString") || strings.Contains(tt.actual, "Date(") {
+			t.Errorf("expected Dart DateTime conversions, got %q", tt.actual)
+		}
+	}
+}
+
+func TestStringifyParse_Int64(t *testing.T) {
+	m := &descriptor.DescriptorProto{Name: proto.String("Account")}
+	d := &descriptor.FileDescriptorProto{Name: proto.String("account.proto")}
+
+	single := mustNewField(t, scalarField("balance", 1, descriptor.FieldDescriptorProto_TYPE_INT64), m, d, nil, Options{})
+	list := mustNewField(t, repeatedField("ids", 2, descriptor.FieldDescriptorProto_TYPE_FIXED64), m, d, nil, Options{})
+
+	tests := []struct {
+		actual, expected string
+	}{
+		{stringify(single), "m.balance.toString()"},
+		{parse(single), "int.parse(m['balance'].toString())"},
+		{stringify(list), "m.ids.map((n) => n.toString()).toList()"},
+		{parse(list), "(m['ids'] as List).map((n) => int.parse(n.toString())).toList()"},
+	}
+
+	for _, tt := range tests {
+		if tt.actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, tt.actual)
+		}
+	}
+}
+
+func TestStringifyParse_RepeatedScalars(t *testing.T) {
+	m := &descriptor.DescriptorProto{Name: proto.String("Tags")}
+	d := &descriptor.FileDescriptorProto{Name: proto.String("tags.proto")}
+
+	names := mustNewField(t, repeatedField("names", 1, descriptor.FieldDescriptorProto_TYPE_STRING), m, d, nil, Options{})
+	counts := mustNewField(t, repeatedField("counts", 2, descriptor.FieldDescriptorProto_TYPE_INT32), m, d, nil, Options{})
+	ratios := mustNewField(t, repeatedField("ratios", 3, descriptor.FieldDescriptorProto_TYPE_DOUBLE), m, d, nil, Options{})
+	count := mustNewField(t, scalarField("count", 4, descriptor.FieldDescriptorProto_TYPE_INT32), m, d, nil, Options{})
+
+	tests := []struct {
+		actual, expected string
+	}{
+		{stringify(names), "m.names"},
+		{parse(names), "List<String>.from(m['names'] as List)"},
+		{stringify(counts), "m.counts"},
+		{parse(counts), "List<int>.from(m['counts'] as List)"},
+		{parse(ratios), "(m['ratios'] as List).map((n) => (n as num).toDouble()).toList()"},
+		{parse(count), "m['count'] as int"},
+	}
+
+	for _, tt := range tests {
+		if tt.actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, tt.actual)
+		}
+	}
+}
+
+func TestStringifyParse_Bytes(t *testing.T) {
+	m := &descriptor.DescriptorProto{Name: proto.String("Blob")}
+	d := &descriptor.FileDescriptorProto{Name: proto.String("blob.proto")}
+
+	data := mustNewField(t, scalarField("data", 1, descriptor.FieldDescriptorProto_TYPE_BYTES), m, d, nil, Options{})
+	chunks := mustNewField(t, repeatedField("chunks", 2, descriptor.FieldDescriptorProto_TYPE_BYTES), m, d, nil, Options{})
+
+	if data.Type != "Uint8List" || chunks.Type != "List<Uint8List>" {
+		t.Fatalf("expected Uint8List types, got %s and %s", data.Type, chunks.Type)
+	}
+
+	tests := []struct {
+		actual, expected string
+	}{
+		{stringify(data), "base64Encode(m.data)"},
+		{parse(data), "base64Decode(m['data'] as String)"},
+		{stringify(chunks), "m.chunks.map(base64Encode).toList()"},
+		{parse(chunks), "(m['chunks'] as List).map((n) => base64Decode(n as String)).toList()"},
+	}
+
+	for _, tt := range tests {
+		if tt.actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, tt.actual)
+		}
+	}
+
+	out := generateClient(t, &descriptor.FileDescriptorProto{
+		Name:        proto.String("blob.proto"),
+		MessageType: []*descriptor.DescriptorProto{{Name: m.Name, Field: []*descriptor.FieldDescriptorProto{scalarField("data", 1, descriptor.FieldDescriptorProto_TYPE_BYTES)}}},
+	}, nil)
+	for _, expected := range []string{"import 'dart:convert';", "import 'dart:typed_data';", "Uint8List? data,"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_PureOptionalBytes(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:   proto.String("blob.proto"),
+		Syntax: proto.String("proto3"),
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("Blob"),
+			Field: []*descriptor.FieldDescriptorProto{
+				scalarField("data", 1, descriptor.FieldDescriptorProto_TYPE_BYTES),
+				scalarField("digest", 2, descriptor.FieldDescriptorProto_TYPE_BYTES),
+				repeatedField("chunks", 3, descriptor.FieldDescriptorProto_TYPE_BYTES),
+			},
+			// optional bytes digest = 2;
+			OneofDecl: []*descriptor.OneofDescriptorProto{{Name: proto.String("_digest")}},
+		}},
+	}
+	d.MessageType[0].Field[1].OneofIndex = proto.Int32(0)
+
+	out := generateClient(t, d, map[string]string{"pure": "true"})
+	for _, expected := range []string{
+		"class Blob {\n  Uint8List data = Uint8List(0);\n  Uint8List? digest;\n  List<Uint8List> chunks = [];\n",
+		"'data': base64Encode(m.data),",
+		"if (m.digest != null) 'digest': base64Encode(m.digest!),",
+		"'chunks': m.chunks.map(base64Encode).toList(),",
+		"this.digest = base64Decode(m['digest'] as String);",
+		"this.chunks = (m['chunks'] as List).map((n) => base64Decode(n as String)).toList();",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+
+	// proto2 optional fields have presence too
+	d.Syntax = proto.String("proto2")
+	out = generateClient(t, d, map[string]string{"pure": "true"})
+	if !strings.Contains(out, "  Uint8List? data;\n") {
+		t.Errorf("expected a nullable proto2 optional bytes field, got:\n%s", out)
+	}
+}
+
+func TestCreateClientAPI_ParameterNames(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{Name: proto.String("Body")})
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("Measure"),
+		InputType:  proto.String(".example.Body"),
+		OutputType: proto.String(".example.Size"),
+	})
+
+	out := generateClient(t, d, nil)
+
+	for _, expected := range []string{
+		"Future<Hat> makeHat(Size size);",
+		"Future<Hat> makeHat(Size size) async {",
+		"Future<Size> measure(Body bodyRequest);",
+		"Future<Size> measure(Body bodyRequest) async {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if strings.Contains(out, "_1") {
+		t.Errorf("expected no _1 suffixed parameters")
+	}
+
+	if got := argName("Utf8"); got != "utf8Request" {
+		t.Errorf("expected utf8 not to be shadowed, got %s", got)
+	}
+}
+
+func TestCreateClientAPI_InjectableClient(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"final Client client;",
+		"TwirpJsonHaberdasher(String hostname, {\n    super.client,",
+		"TwirpProtobufHaberdasher(String hostname, {\n    super.client,",
+		"client = followRedirects ? (client ?? Client()) :",
+		"response = await client.post(",
+		"final client = IOClient(HttpClient(context: context));",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if strings.Contains(out, "await post(") {
+		t.Errorf("expected requests to go through the injected client")
+	}
+}
+
+func mustNewField(t *testing.T, f *descriptor.FieldDescriptorProto, m *descriptor.DescriptorProto, d *descriptor.FileDescriptorProto, gen *generator.Generator, opts Options) ModelField {
+	t.Helper()
+
+	field, err := newField(f, m, d, gen, nil, opts)
+	if err != nil {
+		t.Fatalf("newField returned an error: %v", err)
+	}
+
+	return field
+}
+
+func TestCreateClientAPI_UnsupportedFieldType(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name: proto.String("legacy.proto"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Legacy"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("result", 1, descriptor.FieldDescriptorProto_TYPE_GROUP),
+				},
+			},
+		},
+	}
+
+	_, err := CreateClientAPI(d, nil, nil, Options{})
+	if err == nil {
+		t.Fatalf("expected an error for a group field")
+	}
+
+	for _, expected := range []string{"result", "Legacy", "TYPE_GROUP", "migrate the proto2 group to a nested message"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %q to mention %s", err, expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_MetaStrings(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"Map<String, String> get metaStrings {",
+		"if (value is! Map) {\n      return const {};",
+		"if (v != null) {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_EnumAliases(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("colors.proto"),
+		Package: proto.String("colors"),
+		EnumType: []*descriptor.EnumDescriptorProto{
+			{
+				Name:    proto.String("Color"),
+				Options: &descriptor.EnumOptions{AllowAlias: proto.Bool(true)},
+				Value: []*descriptor.EnumValueDescriptorProto{
+					{Name: proto.String("RED"), Number: proto.Int32(0)},
+					{Name: proto.String("GREEN"), Number: proto.Int32(1)},
+					{Name: proto.String("CRIMSON"), Number: proto.Int32(0)},
+				},
+			},
+		},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Paint"),
+				Field: []*descriptor.FieldDescriptorProto{
+					{
+						Name:     proto.String("color"),
+						Number:   proto.Int32(1),
+						Type:     descriptor.FieldDescriptorProto_TYPE_ENUM.Enum(),
+						TypeName: proto.String(".colors.Color"),
+					},
+				},
+			},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+
+	for _, expected := range []string{
+		"Color JSONToColor(dynamic value) {",
+		"case 'RED':\n    case 'CRIMSON':\n      return Color.RED;",
+		"case 'GREEN':\n      return Color.GREEN;",
+		"String ColorToJSON(Color value) => ColorByValue[value.value] ?? value.name;",
+		"Color? color,",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if strings.Contains(out, "return Color.CRIMSON;") {
+		t.Errorf("expected the CRIMSON alias to decode to the canonical RED value")
+	}
+}
+
+func TestCreateClientAPI_ContentTypes(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	for _, expected := range []string{"'Content-Type': 'application/json',", "'Content-Type': 'application/protobuf',"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain the default %q", expected)
+		}
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{
+		"json_content_type":  "application/json; charset=utf-8",
+		"proto_content_type": "application/proto",
+	})
+	for _, expected := range []string{"'Content-Type': 'application/json; charset=utf-8',", "'Content-Type': 'application/proto',"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_EmptyJSONResponse(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	expected := "if (response.body.trim().isNotEmpty) {\n      tmp.mergeFromProto3Json(codec.decode(response.body), typeRegistry: typeRegistry);\n    }\n    return tmp;"
+	if !strings.Contains(out, expected) {
+		t.Errorf("expected the JSON client to skip decoding empty bodies")
+	}
+}
+
+func TestCreateClientAPI_ErrorDecoder(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	if strings.Count(out, "final Exception Function(Response)? errorDecoder;") != 1 {
+		t.Errorf("expected the client base to declare an errorDecoder")
+	}
+	if strings.Count(out, "super.errorDecoder,") != 2 {
+		t.Errorf("expected both client constructors to accept an errorDecoder")
+	}
+	if strings.Count(out, "if (decoder != null) {\n      return decoder(response);") != 1 {
+		t.Errorf("expected twirpException to delegate to the errorDecoder")
+	}
+}
+
+func TestCreateClientAPI_EnumNumericJSON(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name: proto.String("status.proto"),
+		EnumType: []*descriptor.EnumDescriptorProto{
+			{
+				Name: proto.String("Status"),
+				Value: []*descriptor.EnumValueDescriptorProto{
+					{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+					{Name: proto.String("ACTIVE"), Number: proto.Int32(3)},
+				},
+			},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+
+	for _, expected := range []string{
+		"const Map<String, int> StatusByName = {\n  'UNKNOWN': 0,\n  'ACTIVE': 3,\n};",
+		"const Map<int, String> StatusByValue = {\n  0: 'UNKNOWN',\n  3: 'ACTIVE',\n};",
+		"if (value is int) {\n    value = StatusByValue[value];\n  }",
+		"case 'ACTIVE':\n      return Status.ACTIVE;",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	f := ModelField{Name: "status", JSONName: "status", Type: "Status", InternalType: "Status", IsEnum: true}
+	if got := parse(f); got != "JSONToStatus(m['status'])" {
+		t.Errorf("expected integer and name encoded values to go through JSONToStatus, got %q", got)
+	}
+}
+
+func TestCreateClientAPI_MethodPath(t *testing.T) {
+	d := haberdasherFile()
+	d.Service[0].Method[0].Name = proto.String("make_hat")
+
+	out := generateClient(t, d, nil)
+	if !strings.Contains(out, `var url = "${hostname}${_pathPrefix}make_hat";`) {
+		t.Errorf("expected the raw proto method name in the request path")
+	}
+
+	out = generateClient(t, d, map[string]string{"method_path": "camel"})
+	if !strings.Contains(out, `var url = "${hostname}${_pathPrefix}MakeHat";`) {
+		t.Errorf("expected the CamelCased method name in the request path")
+	}
+}
+
+func TestCreateClientAPI_Close(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	if !strings.Contains(out, "  void close();\n}") {
+		t.Errorf("expected close() on the service interface")
+	}
+	if strings.Count(out, "  void close() {\n    client.close();\n  }") != 1 {
+		t.Errorf("expected the shared client base to close the http client")
+	}
+
+	// an rpc named Close takes precedence over closing the client
+	d := haberdasherFile()
+	d.Service[0].Method[0].Name = proto.String("Close")
+	out = generateClient(t, d, nil)
+	if strings.Contains(out, "void close();") || strings.Contains(out, "    client.close();") {
+		t.Errorf("expected no close() when an rpc is named Close")
+	}
+	if !strings.Contains(out, "Future<Hat> close(Size size);") {
+		t.Errorf("expected the Close rpc on the service interface")
+	}
+}
+
+func TestCreateClientAPI_SharedClientBase(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	base := out[strings.Index(out, "abstract class _TwirpHaberdasherBase {"):]
+	base = base[:strings.Index(base, "\n}\n")]
+	for _, expected := range []string{
+		`final _pathPrefix = "/twirp/example.Haberdasher/";`,
+		"}) : hostname = normalizeTwirpHostname(hostname),",
+		"Exception twirpException(Response response, {String? method}) {",
+		"void close() {",
+	} {
+		if !strings.Contains(base, expected) {
+			t.Errorf("expected the client base to contain %q, got:\n%s", expected, base)
+		}
+	}
+
+	for _, prefix := range []string{"TwirpJson", "TwirpProtobuf"} {
+		if !strings.Contains(out, "class "+prefix+"Haberdasher extends _TwirpHaberdasherBase implements Haberdasher {") {
+			t.Errorf("expected %sHaberdasher to extend the client base", prefix)
+		}
+	}
+	for _, shared := range []string{"final _pathPrefix", "Exception twirpException(", "final String hostname;"} {
+		if n := strings.Count(out, shared); n != 1 {
+			t.Errorf("expected %q once, in the client base, got %d", shared, n)
+		}
+	}
+	if strings.Count(out, "}) : super(hostname);") != 2 {
+		t.Errorf("expected both clients to pass the hostname to the client base")
+	}
+}
+
+func TestStringifyParse_RepeatedEnum(t *testing.T) {
+	m := &descriptor.DescriptorProto{Name: proto.String("Palette")}
+	d := &descriptor.FileDescriptorProto{Name: proto.String("palette.proto")}
+
+	f := repeatedField("colors", 1, descriptor.FieldDescriptorProto_TYPE_ENUM)
+	f.TypeName = proto.String(".colors.Color")
+	colors := mustNewField(t, f, m, d, nil, Options{})
+
+	if colors.Type != "List<Color>" || colors.InternalType != "Color" || !colors.IsEnum {
+		t.Fatalf("expected a List<Color> enum field, got %+v", colors)
+	}
+
+	if got := stringify(colors); got != "m.colors.map(ColorToJSON).toList()" {
+		t.Errorf("unexpected stringify: %q", got)
+	}
+	if got := parse(colors); got != "(m['colors'] as List).map(JSONToColor).toList()" {
+		t.Errorf("unexpected parse: %q", got)
+	}
+}
+
+func TestCreateClientAPI_Builders(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType[0].Field = append(d.MessageType[0].Field,
+		repeatedField("samples", 2, descriptor.FieldDescriptorProto_TYPE_DOUBLE),
+		scalarField("stock", 3, descriptor.FieldDescriptorProto_TYPE_UINT64),
+		messageField("measured_at", 4, ".google.protobuf.Timestamp"),
+	)
+
+	out := generateClient(t, d, nil)
+	if strings.Contains(out, "Builder") {
+		t.Errorf("expected no builders without generate_builders")
+	}
+
+	out = generateClient(t, d, map[string]string{"generate_builders": "true"})
+	for _, expected := range []string{
+		"class SizeBuilder {",
+		"SizeBuilder inches(int value) {\n    _message.inches = value;\n    return this;",
+		"SizeBuilder samples(List<double> value) {\n    _message.samples.addAll(value);",
+		"SizeBuilder stock(int value) {\n    _message.stock = Int64(value);",
+		"SizeBuilder measuredAt(DateTime value) {\n    _message.measuredAt = Timestamp.fromDateTime(value);",
+		"Size build() => _message.clone();",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if strings.Contains(out, "class HatBuilder") {
+		t.Errorf("expected no builder for the Hat output message")
+	}
+}
+
+func TestCreateClientAPI_HeaderProvider(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for expected, count := range map[string]int{
+		"final Map<String, String> Function()? headerProvider;": 1,
+		"super.headerProvider,":                                 2,
+		"...?headerProvider?.call(),":                           3, // both clients and invoke
+	} {
+		if got := strings.Count(out, expected); got != count {
+			t.Errorf("expected %q %d times, found %d", expected, count, got)
+		}
+	}
+}
+
+func mapEntry(name string, key, value *descriptor.FieldDescriptorProto) *descriptor.DescriptorProto {
+	return &descriptor.DescriptorProto{
+		Name:    proto.String(name),
+		Field:   []*descriptor.FieldDescriptorProto{key, value},
+		Options: &descriptor.MessageOptions{MapEntry: proto.Bool(true)},
+	}
+}
+
+func mapField(name string, number int32, entryTypeName string) *descriptor.FieldDescriptorProto {
+	f := messageField(name, number, entryTypeName)
+	f.Label = descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	return f
+}
+
+func TestCreateClientAPI_PureMessageMap(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{
+		Name:  proto.String("Address"),
+		Field: []*descriptor.FieldDescriptorProto{scalarField("street", 1, descriptor.FieldDescriptorProto_TYPE_STRING)},
+	})
+	d.MessageType[1].NestedType = []*descriptor.DescriptorProto{
+		mapEntry("AddressesEntry",
+			scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+			messageField("value", 2, ".example.Address")),
+		mapEntry("FloorsEntry",
+			scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_INT32),
+			messageField("value", 2, ".example.Address")),
+	}
+	d.MessageType[1].Field = append(d.MessageType[1].Field,
+		mapField("addresses", 3, ".example.Hat.AddressesEntry"),
+		mapField("floors", 4, ".example.Hat.FloorsEntry"),
+	)
+
+	out := generateClient(t, d, map[string]string{"pure": "true"})
+	for _, expected := range []string{
+		"  Map<String,Address> addresses = {};",
+		// encoded as a JSON object of the encoded values, with string keys
+		"'addresses': m.addresses.map((k, v) => MapEntry(k, AddressToJSON(v))),",
+		"'floors': m.floors.map((k, v) => MapEntry(k.toString(), AddressToJSON(v))),",
+		// and decoded back entry by entry
+		"this.addresses = (m['addresses'] as Map<String, dynamic>).map((k, v) => MapEntry(k, JSONToAddress(v as Map<String, dynamic>)));",
+		"this.floors = (m['floors'] as Map<String, dynamic>).map((k, v) => MapEntry(int.parse(k), JSONToAddress(v as Map<String, dynamic>)));",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_EnumMap(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("palette.proto"),
+		Package: proto.String("palette"),
+		EnumType: []*descriptor.EnumDescriptorProto{
+			{
+				Name: proto.String("Color"),
+				Value: []*descriptor.EnumValueDescriptorProto{
+					{Name: proto.String("RED"), Number: proto.Int32(0)},
+					{Name: proto.String("GREEN"), Number: proto.Int32(1)},
+				},
+			},
+		},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Palette"),
+				Field: []*descriptor.FieldDescriptorProto{
+					mapField("colors", 1, ".palette.Palette.ColorsEntry"),
+				},
+				NestedType: []*descriptor.DescriptorProto{
+					mapEntry("ColorsEntry",
+						scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+						enumField("value", 2, ".palette.Color")),
+				},
+			},
+		},
+	}
+
+	colors := mustNewField(t, d.MessageType[0].Field[0], d.MessageType[0], d, nil, Options{})
+	if colors.Type != "Map<String,Color>" || !colors.MapValueField.IsEnum {
+		t.Fatalf("expected a Map<String,Color> field, got %+v", colors)
+	}
+	if got := stringify(colors); got != "m.colors.map((k, v) => MapEntry(k, ColorToJSON(v)))" {
+		t.Errorf("expected the values to be encoded by name, got %s", got)
+	}
+	if got := parse(colors); got != "(m['colors'] as Map<String, dynamic>).map((k, v) => MapEntry(k, JSONToColor(v)))" {
+		t.Errorf("expected the values to be decoded by name or number, got %s", got)
+	}
+
+	out := generateClient(t, d, nil)
+	for _, expected := range []string{
+		"Map<String,Color> colors = const {},",
+		"$message.colors.addAll(colors);",
+		"Color JSONToColor(dynamic value) {",
+		"String ColorToJSON(Color value) =>",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_ValueMap(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:       proto.String("config.proto"),
+		Package:    proto.String("config"),
+		Dependency: []string{"google/protobuf/struct.proto"},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Config"),
+				Field: []*descriptor.FieldDescriptorProto{
+					mapField("settings", 1, ".config.Config.SettingsEntry"),
+				},
+				NestedType: []*descriptor.DescriptorProto{
+					mapEntry("SettingsEntry",
+						scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+						messageField("value", 2, ".google.protobuf.Value")),
+				},
+			},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("ConfigService"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("Update"),
+						InputType:  proto.String(".config.Config"),
+						OutputType: proto.String(".config.Config"),
+					},
+				},
+			},
+		},
+	}
+
+	settings := mustNewField(t, d.MessageType[0].Field[0], d.MessageType[0], d, nil, Options{})
+	if settings.Type != "Map<String,dynamic>" || !settings.IsValueMap() {
+		t.Fatalf("expected a Map<String,dynamic> field, got %+v", settings)
+	}
+	if got := stringify(settings); got != "m.settings.map((k, v) => MapEntry(k, v))" {
+		t.Errorf("expected the values to be passed through, got %s", got)
+	}
+	if got := parse(settings); got != "(m['settings'] as Map<String, dynamic>).map((k, v) => MapEntry(k, v))" {
+		t.Errorf("expected the values to be passed through, got %s", got)
+	}
+
+	out := generateClient(t, d, map[string]string{"generate_builders": "true"})
+	for _, expected := range []string{
+		"import 'package:protobuf/well_known_types/google/protobuf/struct.pb.dart';",
+		"Map<String,dynamic> settings = const {},",
+		"$message.settings.addAll(settings.map((k, v) => MapEntry(k, JSONToValue(v))));",
+		"_message.settings.addAll(value.map((k, v) => MapEntry(k, JSONToValue(v))));",
+		"Value JSONToValue(dynamic json) {",
+		"dynamic ValueToJSON(Value value) => value.toProto3Json();",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "struct.twirp.dart") {
+		t.Errorf("expected struct.proto not to be imported as a twirp file")
+	}
+}
+
+func TestApplyMarshalFlags_MapValues(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{Name: proto.String("labels.proto"), Package: proto.String("labels")}
+	stringList := &descriptor.DescriptorProto{
+		Name: proto.String("StringList"),
+		Field: []*descriptor.FieldDescriptorProto{
+			repeatedField("values", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+		},
+	}
+	labels := &descriptor.DescriptorProto{
+		Name: proto.String("Labels"),
+		Field: []*descriptor.FieldDescriptorProto{
+			mapField("values", 1, ".labels.Labels.ValuesEntry"),
+			messageField("parent", 2, ".labels.Labels"),
+		},
+		NestedType: []*descriptor.DescriptorProto{
+			mapEntry("ValuesEntry",
+				scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+				messageField("value", 2, ".labels.StringList")),
+		},
+	}
+	d.MessageType = []*descriptor.DescriptorProto{stringList, labels}
+
+	ctx := NewAPIContext()
+	models := make(map[string]*Model)
+	for _, m := range d.MessageType {
+		model := &Model{Name: m.GetName(), Class: m.GetName()}
+		for _, f := range m.GetField() {
+			model.Fields = append(model.Fields, mustNewField(t, f, m, d, nil, Options{}))
+		}
+		ctx.AddModel(model)
+		models[model.Name] = model
+	}
+
+	if values := models["Labels"].Fields[0]; values.Type != "Map<String,StringList>" {
+		t.Fatalf("expected a Map<String,StringList> field, got %s", values.Type)
+	}
+
+	models["Labels"].CanMarshal = true
+	ctx.ApplyMarshalFlags()
+
+	if !models["StringList"].CanMarshal {
+		t.Errorf("expected the map value model to be marshaled")
+	}
+	if models["StringList"].CanUnmarshal {
+		t.Errorf("expected the map value model not to be unmarshaled")
+	}
+}
+
+func TestStringifyParse_IntegerMapKeys(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{Name: proto.String("lookup.proto"), Package: proto.String("lookup")}
+	m := &descriptor.DescriptorProto{
+		Name: proto.String("Lookup"),
+		NestedType: []*descriptor.DescriptorProto{
+			mapEntry("NamesEntry",
+				scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_INT32),
+				scalarField("value", 2, descriptor.FieldDescriptorProto_TYPE_STRING)),
+		},
+	}
+
+	names := mustNewField(t, mapField("names", 1, ".lookup.Lookup.NamesEntry"), m, d, nil, Options{})
+	if !names.IsMap || names.Type != "Map<int,String>" {
+		t.Fatalf("expected a Map<int,String> field, got %+v", names)
+	}
+
+	if got := stringify(names); got != "m.names.map((k, v) => MapEntry(k.toString(), v))" {
+		t.Errorf("unexpected stringify: %q", got)
+	}
+	if got := parse(names); got != "(m['names'] as Map<String, dynamic>).map((k, v) => MapEntry(int.parse(k), v as String))" {
+		t.Errorf("unexpected parse: %q", got)
+	}
+}
+
+func TestCreateClientAPI_StatusExceptions(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"class TwirpNetworkException extends TwirpException {",
+		"class TwirpClientException extends TwirpJsonException {",
+		"class TwirpServerException extends TwirpJsonException {",
+		"} on ClientException catch (e) {\n        if (attempt < maxRetries) {\n          continue;\n        }\n        throw TwirpNetworkException(e, method: 'example.Haberdasher/MakeHat');",
+		"if (status >= 400 && status < 600) {",
+		"if (status >= 500) {\n        return TwirpServerException(status, code, msg, meta, method: method);",
+		"return TwirpClientException(status, code, msg, meta, method: method);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_GetRequests(t *testing.T) {
+	d := haberdasherFile()
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("GetHat"),
+		InputType:  proto.String(".example.Size"),
+		OutputType: proto.String(".example.Hat"),
+		Options: &descriptor.MethodOptions{
+			IdempotencyLevel: descriptor.MethodOptions_NO_SIDE_EFFECTS.Enum(),
+		},
+	})
+
+	get := "response = await client.get(\n          uri.replace(queryParameters: {'req': base64Encode(utf8.encode(body))}),"
+
+	out := generateClient(t, d, nil)
+	if strings.Contains(out, get) {
+		t.Errorf("expected no GET requests without get_requests")
+	}
+
+	out = generateClient(t, d, map[string]string{"get_requests": "true"})
+	if strings.Count(out, get) != 1 {
+		t.Errorf("expected only the NO_SIDE_EFFECTS method of the JSON client to use GET")
+	}
+	// and invoke too
+	if strings.Count(out, "response = await client.post(") != 4 {
+		t.Errorf("expected the other methods to keep using POST")
+	}
+}
+
+func TestCreateClientAPI_Deterministic(t *testing.T) {
+	d := haberdasherFile()
+	d.Dependency = []string{"zoo.proto", "common.proto"}
+	d.MessageType[0].Field = append(d.MessageType[0].Field, scalarField("raw", 2, descriptor.FieldDescriptorProto_TYPE_BYTES))
+
+	first := generateClient(t, d, nil)
+	for i := 0; i < 10; i++ {
+		if out := generateClient(t, d, nil); out != first {
+			t.Fatalf("expected repeated generation to be byte-identical")
+		}
+	}
+
+	expected := strings.Join([]string{
+		"import 'dart:async';",
+		"import 'dart:convert';",
+		"import 'dart:typed_data';",
+		"import 'package:http/http.dart';",
+		"import 'package:protobuf/protobuf.dart';",
+		"import 'common.twirp.dart';",
+		"import 'haberdasher.pb.dart';",
+		"import 'zoo.twirp.dart';",
+	}, "\n")
+	if !strings.HasPrefix(strings.TrimSpace(withoutHeader(first)), expected) {
+		t.Errorf("expected sorted imports:\n%s\ngot:\n%s", expected, first[:strings.Index(first, "class")])
+	}
+
+	sizeAt, hatAt := strings.Index(first, "Size newSize("), strings.Index(first, "Hat newHat(")
+	if sizeAt < 0 || hatAt < sizeAt {
+		t.Errorf("expected models in proto declaration order")
+	}
+}
+
+func TestCreateClientAPI_HostnameNormalization(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"String normalizeTwirpHostname(String hostname) {",
+		"(uri.scheme != 'http' && uri.scheme != 'https') || uri.host.isEmpty",
+		"throw ArgumentError.value(hostname, 'hostname', 'must be an absolute http or https URL');",
+		"while (normalized.endsWith('/')) {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if strings.Count(out, "}) : hostname = normalizeTwirpHostname(hostname),") != 1 {
+		t.Errorf("expected the client base to normalize the hostname")
+	}
+}
+
+func TestCreateClientAPI_HostnameWithPath(t *testing.T) {
+	for _, hostname := range []string{
+		"https://api.example.com/gateway",
+		"https://api.example.com/gateway/",
+		"https://api.example.com/gateway//",
+	} {
+		out := generateClient(t, haberdasherFile(), map[string]string{"default_hostname": hostname})
+		for _, expected := range []string{
+			"String hostname = 'https://api.example.com/gateway',",
+			`final _pathPrefix = "/twirp/example.Haberdasher/";`,
+			`var url = "${hostname}${_pathPrefix}MakeHat";`,
+		} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("%s: expected output to contain %q", hostname, expected)
+			}
+		}
+		if strings.Contains(out, "gateway/'") || strings.Contains(out, "//twirp") {
+			t.Errorf("%s: expected no double slash before the request path", hostname)
+		}
+	}
+}
+
+func TestCreateClientAPI_SplitInterfaces(t *testing.T) {
+	files := generateFiles(t, haberdasherFile(), map[string]string{"split_interfaces": "true"})
+	if len(files) != 2 {
+		t.Fatalf("expected an interface and a client file, got %d files", len(files))
+	}
+
+	interfaces, clients := files["haberdasher.twirp.dart"], files["haberdasher.client.twirp.dart"]
+
+	for _, expected := range []string{"abstract class Haberdasher {", "class TwirpJsonException", "import 'haberdasher.pb.dart';"} {
+		if !strings.Contains(interfaces, expected) {
+			t.Errorf("expected the interface file to contain %q", expected)
+		}
+	}
+	for _, unexpected := range []string{"package:http", "class TwirpJsonHaberdasher"} {
+		if strings.Contains(interfaces, unexpected) {
+			t.Errorf("expected the interface file not to contain %q", unexpected)
+		}
+	}
+
+	for _, expected := range []string{
+		"import 'package:http/http.dart';",
+		"import 'haberdasher.twirp.dart';",
+		"import 'haberdasher.pb.dart';",
+		"class TwirpJsonHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {",
+		"class TwirpProtobufHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {",
+	} {
+		if !strings.Contains(clients, expected) {
+			t.Errorf("expected the client file to contain %q", expected)
+		}
+	}
+	if strings.Contains(clients, "abstract class Haberdasher") {
+		t.Errorf("expected the interface to live only in the interface file")
+	}
+
+	// the files are generated next to the .pb.dart, so their imports are
+	// relative to the directory of the proto file
+	d := haberdasherFile()
+	d.Name = proto.String("example/hats/haberdasher.proto")
+	files = generateFiles(t, d, map[string]string{"split_interfaces": "true"})
+	interfaces, clients = files["example/hats/haberdasher.twirp.dart"], files["example/hats/haberdasher.client.twirp.dart"]
+	if !strings.Contains(interfaces, "import 'haberdasher.pb.dart';") {
+		t.Errorf("expected the interface file to import its .pb.dart relatively")
+	}
+	for _, expected := range []string{"import 'haberdasher.pb.dart';", "import 'haberdasher.twirp.dart';"} {
+		if !strings.Contains(clients, expected) {
+			t.Errorf("expected the client file to contain %q", expected)
+		}
+	}
+	for name, content := range files {
+		if strings.Contains(content, "import 'example/") {
+			t.Errorf("expected no import relative to the output root in %s", name)
+		}
+	}
+}
+
+func TestCreateClientAPI_AnyField(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:       proto.String("envelope.proto"),
+		Package:    proto.String("envelope"),
+		Dependency: []string{"google/protobuf/any.proto"},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Envelope"),
+				Field: []*descriptor.FieldDescriptorProto{
+					messageField("payload", 1, ".google.protobuf.Any"),
+				},
+			},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+
+	for _, expected := range []string{
+		"import 'package:protobuf/well_known_types/google/protobuf/any.pb.dart';",
+		"Map<String, dynamic> AnyToJSON(Any value, [TypeRegistry registry = const TypeRegistry.empty()]) {",
+		"Any JSONToAny(Map<String, dynamic> json, [TypeRegistry registry = const TypeRegistry.empty()]) {",
+		"GeneratedMessage? unpackAny(Any any, TypeRegistry registry) {",
+		"registry.lookup(any.typeUrl.substring(any.typeUrl.lastIndexOf('/') + 1));",
+		"any.unpackInto(message);",
+		"Any? payload,",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if strings.Contains(out, "any.twirp.dart") {
+		t.Errorf("expected no import of a generated client for google/protobuf/any.proto")
+	}
+
+	// the clients resolve the Any fields of their messages with the registry they were given
+	d.Service = []*descriptor.ServiceDescriptorProto{
+		{
+			Name: proto.String("Mailbox"),
+			Method: []*descriptor.MethodDescriptorProto{
+				{
+					Name:       proto.String("Send"),
+					InputType:  proto.String(".envelope.Envelope"),
+					OutputType: proto.String(".envelope.Envelope"),
+				},
+			},
+		},
+	}
+	out = generateClient(t, d, nil)
+	for _, expected := range []string{
+		"final TypeRegistry typeRegistry;",
+		"this.typeRegistry = const TypeRegistry.empty(),",
+		"super.typeRegistry,",
+		"final body = encodeJson(envelope.toProto3Json(typeRegistry: typeRegistry));",
+		"tmp.mergeFromProto3Json(codec.decode(response.body), typeRegistry: typeRegistry);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	d.Service = nil
+
+	payload := mustNewField(t, messageField("payload", 1, ".google.protobuf.Any"), d.MessageType[0], d, nil, Options{})
+	if got := stringify(payload); got != "AnyToJSON(m.payload)" {
+		t.Errorf("unexpected stringify: %q", got)
+	}
+	if got := parse(payload); got != "JSONToAny(m['payload'] as Map<String, dynamic>)" {
+		t.Errorf("unexpected parse: %q", got)
+	}
+
+	// a message of the file named Any is a regular model
+	d.Dependency = nil
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{Name: proto.String("Any")})
+	d.MessageType[0].Field[0] = messageField("payload", 1, ".envelope.Any")
+	out = generateClient(t, d, nil)
+	if strings.Contains(out, "any.pb.dart") || strings.Contains(out, "unpackAny") {
+		t.Errorf("expected no google.protobuf.Any helpers for envelope.Any")
+	}
+}
+
+func TestCreateClientAPI_RetryIdempotent(t *testing.T) {
+	d := haberdasherFile()
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("PutHat"),
+		InputType:  proto.String(".example.Hat"),
+		OutputType: proto.String(".example.Hat"),
+		Options: &descriptor.MethodOptions{
+			IdempotencyLevel: descriptor.MethodOptions_IDEMPOTENT.Enum(),
+		},
+	})
+
+	out := generateClient(t, d, nil)
+
+	if !strings.Contains(out, "this.maxRetries = 0,") {
+		t.Errorf("expected the clients to take maxRetries")
+	}
+	// connection errors are retried for every method of both clients and invoke
+	if got := strings.Count(out, "} on ClientException catch (e) {\n        if (attempt < maxRetries) {"); got != 5 {
+		t.Errorf("expected connection errors to be retried for every method, got %d", got)
+	}
+
+	retry5xx := "if (response.statusCode >= 500 && attempt < maxRetries) {"
+	if got := strings.Count(out, retry5xx); got != 2 {
+		t.Errorf("expected only PutHat to retry 5xx responses in both clients, got %d", got)
+	}
+	makeHat := out[strings.Index(out, "Future<Hat> makeHat("):strings.Index(out, "Future<Hat> putHat(")]
+	if strings.Contains(makeHat, retry5xx) {
+		t.Errorf("expected the non-idempotent makeHat to not retry 5xx responses")
+	}
+}
+
+func TestCreateClientAPI_FieldMask(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:       proto.String("update.proto"),
+		Package:    proto.String("update"),
+		Dependency: []string{"google/protobuf/field_mask.proto"},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("UpdateHatRequest"),
+				Field: []*descriptor.FieldDescriptorProto{
+					messageField("update_mask", 1, ".google.protobuf.FieldMask"),
+				},
+			},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("Hats"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("UpdateHat"),
+						InputType:  proto.String(".update.UpdateHatRequest"),
+						OutputType: proto.String(".update.UpdateHatRequest"),
+					},
+				},
+			},
+		},
+	}
+
+	mask := mustNewField(t, d.MessageType[0].Field[0], d.MessageType[0], d, nil, Options{})
+	if mask.Type != "List<String>" || mask.IsMessage || !mask.IsFieldMask {
+		t.Fatalf("expected FieldMask to map to List<String>, got %+v", mask)
+	}
+
+	encoded := stringify(mask)
+	if encoded != "m.updateMask.join(',')" {
+		t.Errorf("unexpected stringify: %q", encoded)
+	}
+	// parse reads what stringify wrote under the JSON name
+	if got := parse(mask); got != "(m['update_mask'] as String).split(',').where((p) => p.isNotEmpty).toList()" {
+		t.Errorf("unexpected parse: %q", got)
+	}
+
+	out := generateClient(t, d, nil)
+	for _, expected := range []string{
+		"import 'package:protobuf/well_known_types/google/protobuf/field_mask.pb.dart';",
+		"List<String> updateMask = const [],",
+		"$message.updateMask = FieldMask(paths: updateMask);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "field_mask.twirp.dart") {
+		t.Errorf("expected no import of a generated client for google/protobuf/field_mask.proto")
+	}
+}
+
+func TestCreateClientAPI_DefaultHostname(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if !strings.Contains(out, "TwirpJsonHaberdasher(String hostname, {") {
+		t.Errorf("expected hostname to be required without default_hostname")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"default_hostname": "https://hats.example.com"})
+	for _, expected := range []string{
+		"TwirpJsonHaberdasher({\n    String hostname = 'https://hats.example.com',\n    super.client,",
+		"TwirpProtobufHaberdasher({\n    String hostname = 'https://hats.example.com',\n    super.client,",
+		"Haberdasher createHaberdasher({String hostname = 'https://hats.example.com', TwirpFormat format = TwirpFormat.protobuf, Client? client}) {",
+		"return TwirpJsonHaberdasher(hostname: hostname, client: client);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_ServiceNameCollision(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("ping.proto"),
+		Package: proto.String("ping"),
+		MessageType: []*descriptor.DescriptorProto{
+			{Name: proto.String("Ping")},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("Ping"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("Ping"),
+						InputType:  proto.String(".ping.Ping"),
+						OutputType: proto.String(".ping.Ping"),
+					},
+				},
+			},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+	for _, expected := range []string{
+		"abstract class PingService {",
+		"class TwirpJsonPingService extends _TwirpPingServiceBase implements PingService {",
+		"PingService createPingService(",
+		"Future<Ping> ping(Ping ping);",
+		// the request path keeps the proto service name
+		`final _pathPrefix = "/twirp/ping.Ping/";`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "abstract class Ping {") {
+		t.Errorf("expected the service interface to not collide with the Ping message")
+	}
+
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{Name: proto.String("PingService")})
+	if _, err := CreateClientAPI(d, nil, nil, Options{}); err == nil {
+		t.Errorf("expected an error when the suffixed name collides too")
+	}
+}
+
+func TestCreateClientAPI_StatusCodeFallback(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"String twirpCodeForStatus(int status) {",
+		"case 401:\n      return 'unauthenticated';",
+		"case 400:\n      return 'internal';",
+		"case 404:\n      return 'bad_route';",
+		"case 429:\n    case 502:\n    case 503:\n    case 504:\n      return 'unavailable';",
+		"if (status >= 300 && status < 400) {\n    // redirects are not followed by Twirp clients\n    return 'internal';",
+		"'unexpected HTTP status code $status received, Location=$location',",
+		"'http_error_from_intermediary': 'true',",
+		"default:\n      return 'unknown';",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if got := strings.Count(out, "final code = error?.code ?? twirpCodeForStatus(status);"); got != 1 {
+		t.Errorf("expected the client base to fall back to the status code, got %d", got)
+	}
+}
+
+func TestCreateClientAPI_CodeToHttpStatus(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	if !strings.Contains(out, "const Map<String, int> twirpCodeToHttpStatus = {") {
+		t.Fatalf("expected the twirpCodeToHttpStatus map")
+	}
+	for code, status := range map[string]int{
+		"canceled":            408,
+		"invalid_argument":    400,
+		"malformed":           400,
+		"deadline_exceeded":   408,
+		"not_found":           404,
+		"bad_route":           404,
+		"already_exists":      409,
+		"permission_denied":   403,
+		"unauthenticated":     401,
+		"resource_exhausted":  429,
+		"failed_precondition": 412,
+		"aborted":             409,
+		"out_of_range":        400,
+		"unimplemented":       501,
+		"internal":            500,
+		"unavailable":         503,
+		"dataloss":            500,
+		"unknown":             500,
+	} {
+		if expected := fmt.Sprintf("  '%s': %d,\n", code, status); !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_UnresolvedReference(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{
+		Name: proto.String("Order"),
+		Field: []*descriptor.FieldDescriptorProto{
+			messageField("hat", 1, ".example.Hat"),
+			messageField("box", 2, ".example.Box"),
+		},
+	})
+
+	_, err := CreateClientAPI(d, nil, NewRegistry([]*descriptor.FileDescriptorProto{d}), Options{})
+	if err == nil {
+		t.Fatalf("expected an error for the unknown type .example.Box")
+	}
+	expected := "haberdasher.proto: field box in message Order refers to the unknown message type .example.Box"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err)
+	}
+
+	// a type defined in another file of the request resolves
+	shared := &descriptor.FileDescriptorProto{
+		Name:        proto.String("box.proto"),
+		Package:     proto.String("example"),
+		MessageType: []*descriptor.DescriptorProto{{Name: proto.String("Box")}},
+	}
+	if _, err := CreateClientAPI(d, nil, NewRegistry([]*descriptor.FileDescriptorProto{d, shared}), Options{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateClientAPI_TypePrefix(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{
+		Name: proto.String("Order"),
+		Field: []*descriptor.FieldDescriptorProto{
+			messageField("hat", 1, ".example.Hat"),
+		},
+	})
+
+	out := generateClient(t, d, map[string]string{"type_prefix": "Ex"})
+
+	for _, expected := range []string{
+		"typedef ExSize = Size;",
+		"typedef ExHat = Hat;",
+		"ExOrder newExOrder({",
+		"ExHat? hat,",
+		"abstract class ExHaberdasher {",
+		"Future<ExHat> makeHat(ExSize size);",
+		"class TwirpJsonExHaberdasher extends _TwirpExHaberdasherBase implements ExHaberdasher {",
+		"return ExHat.fromBuffer(response.bodyBytes);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	if out := generateClient(t, haberdasherFile(), nil); strings.Contains(out, "typedef") {
+		t.Errorf("expected no typedefs without type_prefix")
+	}
+}
+
+func TestCreateClientAPI_MethodOrigin(t *testing.T) {
+	d := haberdasherFile()
+
+	out := generateClient(t, d, nil)
+	if got := strings.Count(out, "// from haberdasher.proto: Haberdasher.MakeHat\n"); got != 3 {
+		t.Errorf("expected the interface and both clients to name the origin of makeHat, got %d", got)
+	}
+
+	d.SourceCodeInfo = &descriptor.SourceCodeInfo{
+		Location: []*descriptor.SourceCodeInfo_Location{
+			{Path: []int32{6, 0}, Span: []int32{9, 0, 12, 1}},
+			{Path: []int32{6, 0, 2, 0}, Span: []int32{10, 2, 40}},
+		},
+	}
+	out = generateClient(t, d, nil)
+	if !strings.Contains(out, "// from haberdasher.proto:11: Haberdasher.MakeHat\n") {
+		t.Errorf("expected the origin to include the 1-based line of the rpc")
+	}
+}
+
+func TestNewField_JSType(t *testing.T) {
+	m := &descriptor.DescriptorProto{Name: proto.String("Account")}
+	d := &descriptor.FileDescriptorProto{Name: proto.String("account.proto")}
+
+	id := scalarField("id", 1, descriptor.FieldDescriptorProto_TYPE_INT64)
+	id.Options = &descriptor.FieldOptions{Jstype: descriptor.FieldOptions_JS_STRING.Enum()}
+	field := mustNewField(t, id, m, d, nil, Options{})
+	if field.Type != "String" || field.JSONType != "string" {
+		t.Errorf("expected a JS_STRING int64 to map to String, got %s (%s)", field.Type, field.JSONType)
+	}
+	if got := stringify(field); got != "m.id" {
+		t.Errorf("unexpected stringify: %q", got)
+	}
+	if got := parse(field); got != "m['id'].toString()" {
+		t.Errorf("unexpected parse: %q", got)
+	}
+	// the protoc-gen-dart message keeps an Int64
+	if got := protoValue(field, "id"); got != "Int64.parseInt(id)" {
+		t.Errorf("unexpected protoValue: %q", got)
+	}
+	if got := queryValue("account", field); got != "'${account.id}'" {
+		t.Errorf("unexpected queryValue: %q", got)
+	}
+
+	ids := repeatedField("ids", 2, descriptor.FieldDescriptorProto_TYPE_UINT64)
+	ids.Options = &descriptor.FieldOptions{Jstype: descriptor.FieldOptions_JS_STRING.Enum()}
+	field = mustNewField(t, ids, m, d, nil, Options{})
+	if field.Type != "List<String>" {
+		t.Errorf("expected a repeated JS_STRING uint64 to map to List<String>, got %s", field.Type)
+	}
+	if got := parse(field); got != "(m['ids'] as List).map((n) => n.toString()).toList()" {
+		t.Errorf("unexpected parse: %q", got)
+	}
+	if got := protoValues(field, "ids"); got != "ids.map((v) => Int64.parseInt(v))" {
+		t.Errorf("unexpected protoValues: %q", got)
+	}
+
+	count := scalarField("count", 3, descriptor.FieldDescriptorProto_TYPE_INT64)
+	count.Options = &descriptor.FieldOptions{Jstype: descriptor.FieldOptions_JS_NUMBER.Enum()}
+	if field := mustNewField(t, count, m, d, nil, Options{}); field.Type != "int" {
+		t.Errorf("expected a JS_NUMBER int64 to map to int, got %s", field.Type)
+	}
+
+	// jstype only applies to 64-bit integers
+	small := scalarField("small", 4, descriptor.FieldDescriptorProto_TYPE_INT32)
+	small.Options = &descriptor.FieldOptions{Jstype: descriptor.FieldOptions_JS_STRING.Enum()}
+	if field := mustNewField(t, small, m, d, nil, Options{}); field.Type != "int" {
+		t.Errorf("expected jstype to be ignored on int32, got %s", field.Type)
+	}
+}
+
+func TestCreateClientAPI_ResponseHeaders(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if strings.Contains(out, "WithHeaders") {
+		t.Errorf("expected no WithHeaders variants without response_headers")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"response_headers": "true"})
+	for _, expected := range []string{
+		"Future<(Hat body, Map<String, String> headers)> makeHatWithHeaders(Size size);",
+		"final (body, _) = await makeHatWithHeaders(size);",
+		"return (tmp, response.headers);",
+		"return (Hat.fromBuffer(response.bodyBytes), response.headers);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if got := strings.Count(out, "Future<(Hat body, Map<String, String> headers)> makeHatWithHeaders(Size size) async {"); got != 2 {
+		t.Errorf("expected both clients to implement makeHatWithHeaders, got %d", got)
+	}
+}
+
+func TestCreateClientAPI_ResultErrorStyle(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if strings.Contains(out, "class Result<T, E>") {
+		t.Errorf("expected no Result class with the default error_style")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"error_style": "result"})
+	for _, expected := range []string{
+		"class Result<T, E> {",
+		"const Result.ok(T value) : _value = value, _error = null, isOk = true;",
+		"R fold<R>(R Function(T value) onOk, R Function(E error) onErr) {",
+		"Future<Result<Hat, TwirpException>> makeHat(Size size);",
+		"return Result.ok(await _makeHat(size));",
+		"} on TwirpException catch (e) {\n      return Result.err(e);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if got := strings.Count(out, "Future<Hat> _makeHat(Size size) async {"); got != 2 {
+		t.Errorf("expected both clients to wrap a throwing _makeHat, got %d", got)
+	}
+
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{Name: proto.String("Result")})
+	opts, _ := NewOptions(map[string]string{"error_style": "result"})
+	if _, err := CreateClientAPI(d, nil, nil, opts); err == nil {
+		t.Errorf("expected an error for a message named Result")
+	}
+}
+
+func TestCreateClientAPI_SealedErrorStyle(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), map[string]string{"error_style": "sealed"})
+	for _, expected := range []string{
+		"sealed class TwirpResult<T> {\n  const TwirpResult();\n}",
+		"final class Ok<T> extends TwirpResult<T> {\n  final T value;\n\n  const Ok(this.value);",
+		"final class Err<T> extends TwirpResult<T> {\n  final TwirpException error;\n\n  const Err(this.error);",
+		"Future<TwirpResult<Hat>> makeHat(Size size);",
+		"return Ok(await _makeHat(size));",
+		"} on TwirpException catch (e) {\n      return Err(e);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "class Result<T, E>") {
+		t.Errorf("expected no Result class with error_style=sealed")
+	}
+	if got := strings.Count(out, "Future<Hat> _makeHat(Size size) async {"); got != 2 {
+		t.Errorf("expected both clients to wrap a throwing _makeHat, got %d", got)
+	}
+
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{Name: proto.String("Ok")})
+	opts, _ := NewOptions(map[string]string{"error_style": "sealed"})
+	if _, err := CreateClientAPI(d, nil, nil, opts); err == nil {
+		t.Errorf("expected an error for a message named Ok")
+	}
+}
+
+func TestCreateClientAPI_TwirpHeaders(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"class TwirpHeaders {",
+		"set authorization(String? value) => this['authorization'] = value;",
+		"String? get requestId => this['x-request-id'];",
+		"_headers[name.toLowerCase()] = value;",
+		"Map<String, String> toMap() => Map.of(_headers);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_ValidateRequired(t *testing.T) {
+	d := haberdasherFile()
+	d.Syntax = proto.String("proto2")
+	d.MessageType[0].Field[0].Label = descriptor.FieldDescriptorProto_LABEL_REQUIRED.Enum()
+	d.MessageType[0].Field = append(d.MessageType[0].Field, scalarField("unit", 2, descriptor.FieldDescriptorProto_TYPE_STRING))
+
+	out := generateClient(t, d, nil)
+	if strings.Contains(out, "validate()") {
+		t.Errorf("expected no validation without validate_required")
+	}
+
+	out = generateClient(t, d, map[string]string{"validate_required": "true"})
+	for _, expected := range []string{
+		"extension SizeValidation on Size {",
+		"if (!hasInches()) {\n      throw ArgumentError('Size.inches is required');",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "hasUnit()") {
+		t.Errorf("expected optional fields not to be validated")
+	}
+	if strings.Contains(out, "HatValidation") {
+		t.Errorf("expected no validation for messages without required fields")
+	}
+	if got := strings.Count(out, "Future<Hat> makeHat(Size size) async {\n    size.validate();"); got != 2 {
+		t.Errorf("expected both clients to validate the input before sending, got %d", got)
+	}
+
+	// the result styles return the validation error instead of throwing it
+	out = generateClient(t, d, map[string]string{"validate_required": "true", "error_style": "result"})
+	if !strings.Contains(out, "} on ArgumentError catch (e) {\n      throw TwirpJsonException('invalid_argument', '${e.message}', null, method: 'example.Haberdasher/MakeHat');") {
+		t.Errorf("expected a TwirpException for a missing required field with error_style=result")
+	}
+}
+
+func TestCreateClientAPI_DeprecatedFile(t *testing.T) {
+	d := haberdasherFile()
+	d.Service[0].Name = proto.String("HaberdasherAdmin")
+	d.Service[0].Method[0].Options = &descriptor.MethodOptions{Deprecated: proto.Bool(true)}
+
+	if files := generateFiles(t, d, nil); len(files) != 1 {
+		t.Errorf("expected no deprecated file without deprecated_file, got %d files", len(files))
+	}
+
+	files := generateFiles(t, d, map[string]string{"deprecated_file": "true"})
+	out, ok := files["haberdasher_admin.deprecated.dart"]
+	if !ok {
+		t.Fatalf("expected haberdasher_admin.deprecated.dart, got %v", files)
+	}
+	expected := "\n/// The methods of example.HaberdasherAdmin marked deprecated, by their Dart name.\n" +
+		"const haberdasherAdminDeprecatedMethods = <String>[\n  'makeHat',\n];\n"
+	if got := withoutHeader(out); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestCreateClientAPI_MethodPaths(t *testing.T) {
+	d := haberdasherFile()
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("MakeSize"),
+		InputType:  proto.String(".example.Hat"),
+		OutputType: proto.String(".example.Size"),
+	})
+	out := generateClient(t, d, nil)
+
+	expected := "  static const methodPaths = <String, String>{\n" +
+		"    'makeHat': '/twirp/example.Haberdasher/MakeHat',\n" +
+		"    'makeSize': '/twirp/example.Haberdasher/MakeSize',\n" +
+		"  };\n"
+	if got := strings.Count(out, expected); got != 2 {
+		t.Errorf("expected both clients to map every method to its path, got %d", got)
+	}
+
+	for _, expected := range []string{
+		"static const makeHatPath = '/twirp/example.Haberdasher/MakeHat';",
+		"static const makeSizePath = '/twirp/example.Haberdasher/MakeSize';",
+	} {
+		if got := strings.Count(out, expected); got != 2 {
+			t.Errorf("expected both clients to have the constant %q, got %d", expected, got)
+		}
+	}
+
+	// no constant clashing with an rpc named like it
+	d.Service[0].Method[1].Name = proto.String("MakeHatPath")
+	out = generateClient(t, d, nil)
+	if strings.Contains(out, "static const makeHatPath =") {
+		t.Errorf("expected no makeHatPath constant next to the makeHatPath method")
+	}
+}
+
+func TestCreateClientAPI_Clients(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), map[string]string{"clients": "json"})
+	for _, expected := range []string{
+		"class TwirpJsonHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {",
+		"Haberdasher createHaberdasher(String hostname, {Client? client}) {\n  return TwirpJsonHaberdasher(hostname, client: client);\n}",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "TwirpProtobufHaberdasher") {
+		t.Errorf("expected no protobuf client with clients=json")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"clients": "protobuf"})
+	if !strings.Contains(out, "class TwirpProtobufHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {") || strings.Contains(out, "TwirpJsonHaberdasher") {
+		t.Errorf("expected only the protobuf client with clients=protobuf")
+	}
+}
+
+func TestCreateClientAPI_MetaType(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{
+		Name: proto.String("ErrorDetails"),
+		Field: []*descriptor.FieldDescriptorProto{
+			scalarField("retry_after_seconds", 1, descriptor.FieldDescriptorProto_TYPE_INT32),
+		},
+	})
+
+	if out := generateClient(t, d, nil); strings.Contains(out, "TypedException") {
+		t.Errorf("expected no TypedException without meta_type")
+	}
+
+	out := generateClient(t, d, map[string]string{"meta_type": "example.ErrorDetails"})
+	for _, expected := range []string{
+		"class TypedException extends TwirpJsonException {\n  final ErrorDetails typedMeta;",
+		": typedMeta = decodeMeta(meta),",
+		"factory TypedException.from(TwirpJsonException e) {",
+		"static ErrorDetails decodeMeta(dynamic meta) {",
+		"message.mergeFromProto3Json(meta, ignoreUnknownFields: true);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	opts, _ := NewOptions(map[string]string{"meta_type": "example.Missing"})
+	_, err := CreateClientAPI(d, nil, NewRegistry([]*descriptor.FileDescriptorProto{d}), opts)
+	if err == nil || err.Error() != "meta_type example.Missing: no such top-level message" {
+		t.Errorf("expected an error for an unknown meta_type, got %v", err)
+	}
+}
+
+func TestCreateClientAPI_ErrorEnum(t *testing.T) {
+	d := haberdasherFile()
+	d.EnumType = append(d.EnumType, &descriptor.EnumDescriptorProto{
+		Name: proto.String("HatError"),
+		Value: []*descriptor.EnumValueDescriptorProto{
+			{Name: proto.String("HAT_ERROR_UNSPECIFIED"), Number: proto.Int32(0)},
+			{Name: proto.String("OUT_OF_FELT"), Number: proto.Int32(1)},
+		},
+	})
+
+	if out := generateClient(t, d, nil); strings.Contains(out, "HatErrorException") {
+		t.Errorf("expected no typed exception without error_enum")
+	}
+
+	out := generateClient(t, d, map[string]string{"error_enum": "example.HatError"})
+	for _, expected := range []string{
+		"class HatErrorException extends TwirpJsonException {\n  /// The domain error, null if neither names a value of [HatError].\n  final HatError? error;",
+		": error = parseError(code, meta),",
+		"factory HatErrorException.from(TwirpJsonException e) {",
+		"static HatError? parseError(String code, dynamic meta) {",
+		"if (meta is Map && meta['error'] is String) meta['error'] as String,\n      code.toUpperCase(),",
+		"for (final value in HatError.values) {\n        if (value.name == name) {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+
+	opts, _ := NewOptions(map[string]string{"error_enum": "example.Missing"})
+	_, err := CreateClientAPI(d, nil, NewRegistry([]*descriptor.FileDescriptorProto{d}), opts)
+	if err == nil || err.Error() != "error_enum example.Missing: no such top-level enum" {
+		t.Errorf("expected an error for an unknown error_enum, got %v", err)
+	}
+
+	// the file defining the enum generates the exception
+	other := &descriptor.FileDescriptorProto{Name: proto.String("other.proto"), Package: proto.String("example")}
+	opts, _ = NewOptions(map[string]string{"error_enum": "example.HatError"})
+	if _, err := CreateClientAPI(other, nil, NewRegistry([]*descriptor.FileDescriptorProto{d, other}), opts); err != nil {
+		t.Errorf("unexpected error for an error_enum defined in another file: %v", err)
+	}
+}
+
+func TestCreateClientAPI_Pure(t *testing.T) {
+	d := haberdasherFile()
+	d.EnumType = []*descriptor.EnumDescriptorProto{
+		{
+			Name:    proto.String("Color"),
+			Options: &descriptor.EnumOptions{AllowAlias: proto.Bool(true)},
+			Value: []*descriptor.EnumValueDescriptorProto{
+				{Name: proto.String("RED"), Number: proto.Int32(0)},
+				{Name: proto.String("GREEN"), Number: proto.Int32(1)},
+				{Name: proto.String("VERDANT"), Number: proto.Int32(1)},
+			},
+		},
+	}
+	d.MessageType[1].Field = append(d.MessageType[1].Field,
+		messageField("size", 3, ".example.Size"),
+		enumField("shade", 4, ".example.Color"),
+		messageField("made_at", 5, ".google.protobuf.Timestamp"),
+	)
+
+	out := generateClient(t, d, map[string]string{"pure": "true"})
+	if strings.Contains(out, ".pb.dart") {
+		t.Errorf("expected no .pb.dart import in a pure file")
+	}
+	for _, expected := range []string{
+		"enum Color {\n  RED(0),\n  GREEN(1);\n\n  const Color(this.value);\n\n  final int value;\n  static const VERDANT = GREEN;\n}",
+		"class Hat {\n  String color = '';\n  List<String> tags = [];\n  Size? size;\n  Color shade = Color.values.first;\n  DateTime? madeAt;\n",
+		"Map<String, dynamic> toProto3Json() => HatToJSON(this);",
+		"if (m['size'] != null) {\n      this.size = JSONToSize(m['size'] as Map<String, dynamic>);",
+		"if (m.size != null) 'size': SizeToJSON(m.size!),",
+		"'shade': ColorToJSON(m.shade),",
+		"if (m.madeAt != null) 'made_at': m.madeAt!.toUtc().toIso8601String(),",
+		"Hat clone() => Hat()..mergeFromProto3Json(toProto3Json());",
+		"Hat JSONToHat(Map<String, dynamic> json) => Hat()..mergeFromProto3Json(json);",
+		"class TwirpJsonHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "TwirpProtobufHaberdasher") {
+		t.Errorf("expected no protobuf client in a pure file")
+	}
+
+	d.MessageType[1].Field = append(d.MessageType[1].Field, messageField("extra", 6, ".google.protobuf.Any"))
+	opts, _ := NewOptions(map[string]string{"pure": "true"})
+	if _, err := CreateClientAPI(d, nil, nil, opts); err == nil || !strings.Contains(err.Error(), "pure files only support the messages and enums of the file") {
+		t.Errorf("expected an error for an Any field in a pure file, got %v", err)
+	}
+}
+
+func TestCreateClientAPI_Freezed(t *testing.T) {
+	d := haberdasherFile()
+	d.EnumType = []*descriptor.EnumDescriptorProto{
+		{
+			Name:  proto.String("Color"),
+			Value: []*descriptor.EnumValueDescriptorProto{{Name: proto.String("RED"), Number: proto.Int32(0)}},
+		},
+	}
+	d.MessageType[1].Field = append(d.MessageType[1].Field,
+		messageField("size", 3, ".example.Size"),
+		enumField("shade", 4, ".example.Color"),
+		messageField("made_at", 5, ".google.protobuf.Timestamp"),
+		scalarField("stock", 6, descriptor.FieldDescriptorProto_TYPE_INT64),
+	)
+
+	out := generateClient(t, d, map[string]string{"use_freezed": "true"})
+	for _, expected := range []string{
+		"import 'package:freezed_annotation/freezed_annotation.dart';",
+		"import 'package:json_annotation/json_annotation.dart';",
+		"import 'package:protobuf/well_known_types/google/protobuf/timestamp.pb.dart';",
+		"part 'haberdasher.twirp.freezed.dart';\npart 'haberdasher.twirp.g.dart';",
+		"@freezed\nabstract class HatData with _$HatData {\n  const HatData._();",
+		"  const factory HatData({\n    @Default('') String color,\n    @Default(<String>[]) List<String> tags,\n    SizeData? size,\n    @_ColorConverter() Color? shade,\n    DateTime? madeAt,\n    @Default(0) int stock,\n  }) = _HatData;",
+		"factory HatData.fromJson(Map<String, dynamic> json) => _$HatDataFromJson(json);",
+		"if (size != null) {\n      $message.size = size!.toProto();\n    }",
+		"$message.madeAt = Timestamp.fromDateTime(madeAt!);",
+		"extension HatFreezed on Hat {",
+		"size: hasSize() ? size.toFreezed() : null,",
+		"madeAt: hasMadeAt() ? madeAt.toDateTime() : null,",
+		"stock: stock.toInt(),",
+		"$message.stock = Int64(stock);",
+		"class _ColorConverter implements JsonConverter<Color, String> {",
+		"factory SizeData.fromJson(Map<String, dynamic> json) => _$SizeDataFromJson(json);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	d.MessageType[1].Field = append(d.MessageType[1].Field, messageField("extra", 7, ".google.protobuf.Any"))
+	opts, _ := NewOptions(map[string]string{"use_freezed": "true"})
+	if _, err := CreateClientAPI(d, nil, nil, opts); err == nil || !strings.Contains(err.Error(), "freezed copies only refer to the top-level messages of the file") {
+		t.Errorf("expected an error for an Any field with use_freezed, got %v", err)
+	}
+}
+
+func TestCreateClientAPI_JSONCodec(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	for _, expected := range []string{
+		"final bool prettyPrint;\n  final JsonCodec codec;",
+		"this.prettyPrint = false,\n    this.codec = json,",
+		"return codec.encode(value);",
+		"tmp.mergeFromProto3Json(codec.decode(response.body), typeRegistry: typeRegistry);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if got := strings.Count(out, "JsonCodec codec"); got != 1 {
+		t.Errorf("expected only the JSON client to take a codec, got %d", got)
+	}
+}
+
+func TestCreateClientAPI_Invoke(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"Future<dynamic> invoke(String method, dynamic jsonRequest) async {",
+		`var url = "${hostname}${_pathPrefix}${method}";`,
+		"final body = encodeJson(jsonRequest);",
+		"return codec.decode(response.body);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if got := strings.Count(out, "Future<dynamic> invoke("); got != 1 {
+		t.Errorf("expected only the JSON client to have invoke, got %d", got)
+	}
+
+	// an rpc named Invoke takes precedence over the dynamic entrypoint
+	d := haberdasherFile()
+	d.Service[0].Method[0].Name = proto.String("Invoke")
+	if out := generateClient(t, d, nil); strings.Contains(out, "Future<dynamic> invoke(") {
+		t.Errorf("expected no dynamic invoke when an rpc is named Invoke")
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	for in, expected := range map[string]string{
+		"user_id":      "userId",
+		"http_url":     "httpUrl",
+		"oauth2_token": "oauth2Token",
+		"userID":       "userID",
+		"http_URL":     "httpURL",
+		"User_name":    "userName",
+		"a__b":         "aB",
+		"field_2":      "field2",
+		"inches":       "inches",
+	} {
+		if got := camelCase(in); got != expected {
+			t.Errorf("camelCase(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_ContentTypeDispatch(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if strings.Contains(out, "decodeTwirpResponse") {
+		t.Errorf("expected no content type dispatch without content_type_dispatch")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{
+		"content_type_dispatch": "true",
+		"proto_content_type":    "application/x-protobuf",
+	})
+	for _, expected := range []string{
+		"import 'package:protobuf/protobuf.dart';",
+		"T decodeTwirpResponse<T extends GeneratedMessage>(Response response, T message, {required bool json, JsonCodec codec = const JsonCodec(), TypeRegistry typeRegistry = const TypeRegistry.empty()}) {",
+		"final contentType = response.headers['content-type'] ?? '';",
+		"if (contentType.startsWith('application/x-protobuf')) {",
+		"} else if (contentType.startsWith('application/json')) {",
+		"final tmp = decodeTwirpResponse(response, Hat(), json: true, codec: codec, typeRegistry: typeRegistry);",
+		"final tmp = decodeTwirpResponse(response, Hat(), json: false, typeRegistry: typeRegistry);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "return Hat.fromBuffer(response.bodyBytes);") {
+		t.Errorf("expected the protobuf client to decode through decodeTwirpResponse")
+	}
+}
+
+func TestCreateClientAPI_PartFiles(t *testing.T) {
+	d := haberdasherFile()
+	d.Name = proto.String("example/haberdasher.proto")
+
+	files := generateFiles(t, d, map[string]string{"part_files": "true"})
+	if len(files) != 2 {
+		t.Fatalf("expected a library and a part file, got %d files", len(files))
+	}
+
+	library, ok := files["example/haberdasher.twirp.dart"]
+	if !ok {
+		t.Fatalf("expected example/haberdasher.twirp.dart, got %v", files)
+	}
+	if !strings.HasPrefix(withoutHeader(library), "\nlibrary example.haberdasher.twirp;\n\nimport ") {
+		t.Errorf("expected the library declaration before the imports")
+	}
+	part := strings.Index(library, "\npart 'haberdasher.models.twirp.dart';\n")
+	if part < 0 || part < strings.LastIndex(library, "\nimport ") {
+		t.Errorf("expected the part directive after the imports")
+	}
+	if strings.Contains(library, "Size newSize(") {
+		t.Errorf("expected the model helpers to move to the part file")
+	}
+	if !strings.Contains(library, "abstract class Haberdasher {") {
+		t.Errorf("expected the service interface to stay in the library")
+	}
+
+	models, ok := files["example/haberdasher.models.twirp.dart"]
+	if !ok {
+		t.Fatalf("expected example/haberdasher.models.twirp.dart, got %v", files)
+	}
+	if !strings.HasPrefix(withoutHeader(models), "\npart of 'haberdasher.twirp.dart';\n") {
+		t.Errorf("expected the part file to start with its part of directive")
+	}
+	if strings.Contains(models, "import ") {
+		t.Errorf("expected no imports in the part file")
+	}
+	for _, expected := range []string{"extension SizeDebug on Size {", "Size newSize("} {
+		if !strings.Contains(models, expected) {
+			t.Errorf("expected the part file to contain %q", expected)
+		}
+	}
+}
+
+func TestDartLibraryName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"service.proto":            "service.twirp",
+		"example/service.proto":    "example.service.twirp",
+		"my-org/2fa/Auth.v1.proto": "my_org._2fa.auth_v1.twirp",
+	} {
+		d := &descriptor.FileDescriptorProto{Name: proto.String(name)}
+		if got := dartLibraryName(d); got != expected {
+			t.Errorf("dartLibraryName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestNewField_SimilarMapEntryNames(t *testing.T) {
+	m := &descriptor.DescriptorProto{
+		Name: proto.String("Inventory"),
+		NestedType: []*descriptor.DescriptorProto{
+			// BarFooEntry ends with FooEntry, it must not be taken for it
+			mapEntry("BarFooEntry",
+				scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+				scalarField("value", 2, descriptor.FieldDescriptorProto_TYPE_BOOL)),
+			mapEntry("FooEntry",
+				scalarField("key", 1, descriptor.FieldDescriptorProto_TYPE_INT64),
+				scalarField("value", 2, descriptor.FieldDescriptorProto_TYPE_STRING)),
+		},
+		Field: []*descriptor.FieldDescriptorProto{
+			mapField("foo", 1, ".shop.Inventory.FooEntry"),
+			mapField("bar_foo", 2, ".shop.Inventory.BarFooEntry"),
+		},
+	}
+	d := &descriptor.FileDescriptorProto{
+		Name:        proto.String("shop.proto"),
+		Package:     proto.String("shop"),
+		MessageType: []*descriptor.DescriptorProto{m},
+	}
+
+	foo := mustNewField(t, m.Field[0], m, d, nil, Options{})
+	if foo.Type != "Map<int,String>" {
+		t.Errorf("expected foo to be a Map<int,String>, got %s", foo.Type)
+	}
+	barFoo := mustNewField(t, m.Field[1], m, d, nil, Options{})
+	if barFoo.Type != "Map<String,bool>" {
+		t.Errorf("expected barFoo to be a Map<String,bool>, got %s", barFoo.Type)
+	}
+
+	// a message nested deeper resolves against its own scope
+	outer := &descriptor.DescriptorProto{Name: proto.String("Outer"), NestedType: []*descriptor.DescriptorProto{m}}
+	d.MessageType = []*descriptor.DescriptorProto{outer}
+	m.Field[0].TypeName = proto.String(".shop.Outer.Inventory.FooEntry")
+	if foo := mustNewField(t, m.Field[0], m, d, nil, Options{}); foo.Type != "Map<int,String>" {
+		t.Errorf("expected the nested foo to be a Map<int,String>, got %s", foo.Type)
+	}
+}
+
+func TestCreateClientAPI_ListOutput(t *testing.T) {
+	opts := &descriptor.MethodOptions{}
+	if err := proto.SetExtension(opts, E_ListOutput, proto.Bool(true)); err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+	// the option arrives from protoc in the serialized descriptor
+	data, err := proto.Marshal(opts)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	received := &descriptor.MethodOptions{}
+	if err := proto.Unmarshal(data, received); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	d := haberdasherFile()
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("ListHats"),
+		InputType:  proto.String(".example.Size"),
+		OutputType: proto.String(".example.Hat"),
+		Options:    received,
+	})
+
+	out := generateClient(t, d, nil)
+	for _, expected := range []string{
+		"Future<List<Hat>> listHats(Size size);",
+		"Future<Hat> makeHat(Size size);",
+		"final tmp = <Hat>[\n      if (response.body.trim().isNotEmpty)\n        for (final item in jsonDecode(response.body) as List)\n          Hat()..mergeFromProto3Json(item, typeRegistry: typeRegistry),\n    ];",
+		// the protobuf client calls list rpcs with JSON
+		"final body = jsonEncode(size.toProto3Json(typeRegistry: typeRegistry));",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if got := strings.Count(out, "Future<List<Hat>> listHats(Size size) async {"); got != 2 {
+		t.Errorf("expected both clients to implement listHats, got %d", got)
+	}
+	for _, decode := range []string{"codec.decode", "jsonDecode"} {
+		if !strings.Contains(out, "for (final item in "+decode+"(response.body) as List)") {
+			t.Errorf("expected both clients to decode a JSON array, missing %s", decode)
+		}
+	}
+}
+
+func TestCreateClientAPI_MethodEncoding(t *testing.T) {
+	encoding := func(value string) *descriptor.MethodOptions {
+		opts := &descriptor.MethodOptions{}
+		if err := proto.SetExtension(opts, E_Encoding, proto.String(value)); err != nil {
+			t.Fatalf("SetExtension: %v", err)
+		}
+		return opts
+	}
+
+	d := haberdasherFile()
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("ResizeHat"),
+		InputType:  proto.String(".example.Hat"),
+		OutputType: proto.String(".example.Hat"),
+		Options:    encoding("json"),
+	})
+
+	out := generateClient(t, d, map[string]string{"clients": "protobuf"})
+	resize := out[strings.Index(out, "Future<Hat> resizeHat(Hat hat) async {"):]
+	resize = resize[:strings.Index(resize, "\n  }\n")]
+	for _, expected := range []string{
+		"// the (twirp_dart.encoding) option forces JSON\n    final body = jsonEncode(hat.toProto3Json(typeRegistry: typeRegistry));",
+		"'Content-Type': 'application/json',",
+		"tmp.mergeFromProto3Json(jsonDecode(response.body), typeRegistry: typeRegistry);",
+	} {
+		if !strings.Contains(resize, expected) {
+			t.Errorf("expected resizeHat to contain %q, got:\n%s", expected, resize)
+		}
+	}
+	if strings.Count(out, "final body = size.writeToBuffer();") != 1 || strings.Count(out, "return Hat.fromBuffer(response.bodyBytes);") != 1 {
+		t.Errorf("expected makeHat to keep the protobuf encoding")
+	}
+
+	d.Service[0].Method[1].Options = encoding("xml")
+	opts, _ := NewOptions(nil)
+	if _, err := CreateClientAPI(d, nil, nil, opts); err == nil || !strings.Contains(err.Error(), `invalid (twirp_dart.encoding) "xml"`) {
+		t.Errorf("expected an error for an unknown encoding, got %v", err)
+	}
+}
+
+func TestCreateClientAPI_MethodTimeout(t *testing.T) {
+	d := haberdasherFile()
+	d.Service[0].Method[0].Options = &descriptor.MethodOptions{}
+	if err := proto.SetExtension(d.Service[0].Method[0].Options, E_TimeoutMs, proto.Uint32(5000)); err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+
+	out := generateClient(t, d, nil)
+	for _, expected := range []string{
+		"Future<Hat> makeHat(Size size, {Duration? timeout});",
+		"Future<Hat> makeHat(Size size, {Duration? timeout}) async {",
+		").timeout(timeout ?? const Duration(milliseconds: 5000));",
+		"} on TimeoutException catch (e) {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if n := strings.Count(out, "const Duration(milliseconds: 5000)"); n != 2 {
+		t.Errorf("expected the default timeout in both clients, got %d", n)
+	}
+	if strings.Contains(out, "Future<Size> makeSize(Hat hat, {Duration? timeout})") {
+		t.Errorf("expected no timeout parameter for a method without the option")
+	}
+}
+
+func TestCreateClientAPI_LastRequestID(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if strings.Contains(out, "lastRequestId") {
+		t.Errorf("expected no lastRequestId without last_request_id")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"last_request_id": "true"})
+	if strings.Count(out, "  String? lastRequestId;") != 1 {
+		t.Errorf("expected the client base to declare lastRequestId")
+	}
+	// makeHat in both clients and invoke
+	assign := "    lastRequestId = response.headers['request-id'];\n    if (response.statusCode != 200) {"
+	if got := strings.Count(out, assign); got != 3 {
+		t.Errorf("expected every call to set lastRequestId, got %d", got)
+	}
+}
+
+func TestCreateClientAPI_GetSafeQuery(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType[0].Field = append(d.MessageType[0].Field,
+		&descriptor.FieldDescriptorProto{
+			Name:     proto.String("brand_name"),
+			JsonName: proto.String("brandName"),
+			Number:   proto.Int32(2),
+			Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+		},
+	)
+	d.Service[0].Method[0].Options = &descriptor.MethodOptions{}
+	if err := proto.SetExtension(d.Service[0].Method[0].Options, E_GetSafe, proto.Bool(true)); err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+
+	out := generateClient(t, d, nil)
+	expected := "  String makeHatQuery(Size size) {\n    return Uri(queryParameters: {\n      'inches': '${size.inches}',\n      'brandName': size.brandName,\n    }).query;\n  }"
+	if !strings.Contains(out, expected) {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+	}
+	if strings.Count(out, "makeHatQuery(") != 1 {
+		t.Errorf("expected the query helper once, in the client base")
+	}
+	if strings.Contains(out, "makeSizeQuery(") {
+		t.Errorf("expected no query helper without (twirp_dart.get_safe)")
+	}
+}
+
+func TestCreateClientAPI_PositionalArgs(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType[0].Field = append(d.MessageType[0].Field,
+		&descriptor.FieldDescriptorProto{
+			Name:     proto.String("brand"),
+			JsonName: proto.String("brand"),
+			Number:   proto.Int32(2),
+			Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+		},
+		scalarField("batch", 3, descriptor.FieldDescriptorProto_TYPE_INT64),
+	)
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("MakeSize"),
+		InputType:  proto.String(".example.Hat"),
+		OutputType: proto.String(".example.Size"),
+	})
+
+	out := generateClient(t, d, nil)
+	if strings.Contains(out, "makeHatWith(") {
+		t.Errorf("expected no shorthand without positional_args")
+	}
+
+	out = generateClient(t, d, map[string]string{"positional_args": "true"})
+	for _, expected := range []string{
+		"extension HaberdasherPositional on Haberdasher {",
+		"Future<Hat> makeHatWith(int inches, String brand, int batch) {\n    return makeHat(Size()..inches = inches..brand = brand..batch = Int64(batch));\n  }",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	// Hat has a repeated field
+	if strings.Contains(out, "makeSizeWith(") {
+		t.Errorf("expected no shorthand for an input with non-scalar fields")
+	}
+}
+
+func TestCreateClientAPI_SameInputAndOutput(t *testing.T) {
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("echo.proto"),
+		Package: proto.String("echo"),
+		MessageType: []*descriptor.DescriptorProto{
+			{Name: proto.String("Msg")},
+			{Name: proto.String("Timeout")},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("Echoer"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{Name: proto.String("Echo"), InputType: proto.String(".echo.Msg"), OutputType: proto.String(".echo.Msg")},
+					{
+						Name:       proto.String("Wait"),
+						InputType:  proto.String(".echo.Timeout"),
+						OutputType: proto.String(".echo.Timeout"),
+						Options:    &descriptor.MethodOptions{},
+					},
+				},
+			},
+		},
+	}
+	if err := proto.SetExtension(d.Service[0].Method[1].Options, E_TimeoutMs, proto.Uint32(100)); err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+
+	out := generateClient(t, d, nil)
+	for _, expected := range []string{
+		"Future<Msg> echo(Msg msg) async {",
+		"final body = encodeJson(msg.toProto3Json(typeRegistry: typeRegistry));",
+		"final body = msg.writeToBuffer();",
+		"final tmp = Msg();",
+		"return Msg.fromBuffer(response.bodyBytes);",
+		// the argument must not shadow the timeout parameter
+		"Future<Timeout> wait(Timeout timeoutRequest, {Duration? timeout}) async {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+}
+
+func TestCreateClientAPI_Indent(t *testing.T) {
+	for _, params := range []map[string]string{
+		nil,
+		{"error_style": "result", "batch": "true"},
+		{"error_style": "sealed", "oneof_style": "sealed", "get_requests": "true"},
+		{"use_freezed": "true", "generate_builders": "true", "validate_required": "true"},
+		{"pure": "true", "part_files": "true"},
+		{"clients": "protobuf", "response_headers": "true"},
+	} {
+		for name, out := range generateFiles(t, haberdasherFile(), params) {
+			if strings.Contains(out, "\t") {
+				t.Errorf("%v %s: expected no tabs", params, name)
+			}
+			if strings.Contains(out, "\n\n\n") {
+				t.Errorf("%v %s: expected no runs of blank lines", params, name)
+			}
+			// every line is indented by whole levels of 2 spaces, at most one
+			// level deeper than the line before it and exactly one level
+			// deeper than an opening brace
+			prevLevel, prevLine := 0, ""
+			for i, line := range strings.Split(out, "\n") {
+				if strings.TrimRight(line, " ") != line {
+					t.Errorf("%v %s line %d: expected no trailing whitespace in %q", params, name, i+1, line)
+				}
+				trimmed := strings.TrimLeft(line, " ")
+				if trimmed == "" {
+					continue
+				}
+				level := (len(line) - len(trimmed)) / 2
+				switch {
+				case (len(line)-len(trimmed))%2 != 0:
+					t.Errorf("%v %s line %d: expected an indentation of whole levels in %q", params, name, i+1, line)
+				case level > prevLevel+1:
+					t.Errorf("%v %s line %d: expected at most one level more than %q in %q", params, name, i+1, prevLine, line)
+				case strings.HasSuffix(prevLine, "{") && !strings.HasPrefix(prevLine, "//") && !strings.HasPrefix(trimmed, "}") && level != prevLevel+1:
+					t.Errorf("%v %s line %d: expected one level more than %q in %q", params, name, i+1, prevLine, line)
+				}
+				prevLevel, prevLine = level, trimmed
+			}
+		}
+	}
+
+	out := generateClient(t, haberdasherFile(), nil)
+	for _, expected := range []string{
+		"\n  Future<Hat> makeHat(Size size);\n",
+		"\n  String toString() {\n    return 'TwirpException{message: $message, method: $method}';\n  }\n",
+		"\n  factory TwirpJsonException.fromJson(Map<String, dynamic> json, {String? method}) {\n    return TwirpJsonException(\n      json['code'] as String,",
+		// one blank line between the constructor and the methods of the clients
+		"\n  }) : super(hostname);\n\n  // from haberdasher.proto: Haberdasher.MakeHat\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"indent": "4"})
+	if !strings.Contains(out, "\n    Future<Hat> makeHat(Size size);\n") {
+		t.Errorf("expected 4 spaces per level with indent=4")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"indent": "tab"})
+	if !strings.Contains(out, "\n\tFuture<Hat> makeHat(Size size);\n") {
+		t.Errorf("expected tabs with indent=tab")
+	}
+	if strings.Contains(out, " \n") || strings.Contains(out, "\t\n") || strings.Contains(out, "\n\n\n") {
+		t.Errorf("expected the whitespace to be normalized with indent=tab too")
+	}
+}
+
+func TestCreateClientAPI_PackageNotAnIdentifier(t *testing.T) {
+	d := haberdasherFile()
+	d.Name = proto.String("my-api/v1/haberdasher.proto")
+	d.Package = proto.String("my-api.v1")
+	for _, m := range d.MessageType {
+		for _, f := range m.Field {
+			if f.TypeName != nil {
+				f.TypeName = proto.String(strings.Replace(f.GetTypeName(), ".example.", ".my-api.v1.", 1))
+			}
+		}
+	}
+	for _, m := range d.Service[0].Method {
+		m.InputType = proto.String(strings.Replace(m.GetInputType(), ".example.", ".my-api.v1.", 1))
+		m.OutputType = proto.String(strings.Replace(m.GetOutputType(), ".example.", ".my-api.v1.", 1))
+	}
+
+	files := generateFiles(t, d, map[string]string{"part_files": "true"})
+	out := files["my-api/v1/haberdasher.twirp.dart"]
+	for _, expected := range []string{
+		`final _pathPrefix = "/twirp/my-api.v1.Haberdasher/";`,
+		"'makeHat': '/twirp/my-api.v1.Haberdasher/MakeHat',",
+		"throw twirpException(response, method: 'my-api.v1.Haberdasher/MakeHat');",
+		"library my_api.v1.haberdasher.twirp;",
+		"class TwirpJsonHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	// the package only appears verbatim in strings and comments, never in
+	// an identifier
+	for _, content := range files {
+		for _, line := range strings.Split(content, "\n") {
+			trimmed := strings.TrimSpace(line)
+			if strings.Contains(line, "my-api") && !strings.HasPrefix(trimmed, "//") && !strings.ContainsAny(line, `'"`) {
+				t.Errorf("expected the package in a string or comment, got %q", line)
+			}
+		}
+	}
+}
+
+func TestCreateClientAPI_BearerToken(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	if strings.Count(out, "void setBearerToken(String? token) {\n    _bearerToken = token;\n  }") != 1 {
+		t.Errorf("expected setBearerToken once, in the client base")
+	}
+	// both clients and invoke, before the headerProvider so it can override the token
+	header := "if (_bearerToken != null) 'Authorization': 'Bearer $_bearerToken',\n      ...?headerProvider?.call(),"
+	if got := strings.Count(out, header); got != 3 {
+		t.Errorf("expected every request to send the bearer token, got %d", got)
+	}
+}
+
+func TestCreateClientAPI_DeterministicFiles(t *testing.T) {
+	d := haberdasherFile()
+	d.EnumType = []*descriptor.EnumDescriptorProto{
+		{Name: proto.String("Color"), Value: []*descriptor.EnumValueDescriptorProto{{Name: proto.String("RED"), Number: proto.Int32(0)}}},
+		{Name: proto.String("Shape"), Value: []*descriptor.EnumValueDescriptorProto{{Name: proto.String("ROUND"), Number: proto.Int32(0)}}},
+	}
+	d.MessageType[1].Field = append(d.MessageType[1].Field,
+		messageField("size", 3, ".example.Size"),
+		enumField("shade", 4, ".example.Color"),
+		enumField("shape", 5, ".example.Shape"),
+		messageField("made_at", 6, ".google.protobuf.Timestamp"),
+	)
+	opts, err := NewOptions(map[string]string{
+		"use_freezed":       "true",
+		"generate_builders": "true",
+		"split_interfaces":  "true",
+		"deprecated_file":   "true",
+	})
+	if err != nil {
+		t.Fatalf("NewOptions returned an error: %v", err)
+	}
+
+	generate := func() []*plugin_go.CodeGeneratorResponse_File {
+		files, err := CreateClientAPI(d, nil, nil, opts)
+		if err != nil {
+			t.Fatalf("CreateClientAPI returned an error: %v", err)
+		}
+		return files
+	}
+
+	first := generate()
+	for i := 0; i < 20; i++ {
+		files := generate()
+		if len(files) != len(first) {
+			t.Fatalf("expected %d files, got %d", len(first), len(files))
+		}
+		for j, f := range files {
+			if f.GetName() != first[j].GetName() || f.GetContent() != first[j].GetContent() {
+				t.Fatalf("expected %s to be generated the same every time", first[j].GetName())
+			}
+		}
+	}
+}
+
+func TestCreateClientAPI_FollowRedirects(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"class _TwirpNoRedirectClient extends BaseClient {",
+		"Future<StreamedResponse> send(BaseRequest request) {\n    request.followRedirects = false;\n    return _inner.send(request);",
+		"final bool followRedirects;",
+		"this.followRedirects = true,",
+		"client = followRedirects ? (client ?? Client()) : _TwirpNoRedirectClient(client ?? Client());",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Count(out, "super.followRedirects,") != 2 {
+		t.Errorf("expected both client constructors to accept followRedirects")
+	}
+}
+
+func TestCreateClientAPI_DocumentErrors(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if strings.Contains(out, "/// Throws a [TwirpException]") {
+		t.Errorf("expected no throws documentation without document_errors")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"document_errors": "true"})
+	for _, expected := range []string{
+		"  // from haberdasher.proto: Haberdasher.MakeHat\n  /// Throws a [TwirpException] on a transport or server error:\n",
+		"/// unavailable, dataloss or unknown, see [twirpCodeToHttpStatus].\n  Future<Hat> makeHat(Size size);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"document_errors": "true", "error_style": "result"})
+	if !strings.Contains(out, "/// Completes with an error [Result] holding a [TwirpException] on a") {
+		t.Errorf("expected the result style to be documented")
+	}
+}
+
+func TestCreateClientAPI_HealthMethod(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType = append(d.MessageType,
+		&descriptor.DescriptorProto{Name: proto.String("HealthRequest")},
+		&descriptor.DescriptorProto{
+			Name:  proto.String("HealthResponse"),
+			Field: []*descriptor.FieldDescriptorProto{enumField("status", 1, ".example.ServingStatus")},
+		},
+	)
+	d.EnumType = append(d.EnumType, &descriptor.EnumDescriptorProto{
+		Name: proto.String("ServingStatus"),
+		Value: []*descriptor.EnumValueDescriptorProto{
+			{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+			{Name: proto.String("SERVING"), Number: proto.Int32(1)},
+			{Name: proto.String("NOT_SERVING"), Number: proto.Int32(2)},
+		},
+	})
+	d.Service[0].Method = append(d.Service[0].Method, &descriptor.MethodDescriptorProto{
+		Name:       proto.String("Health"),
+		InputType:  proto.String(".example.HealthRequest"),
+		OutputType: proto.String(".example.HealthResponse"),
+	})
+
+	out := generateClient(t, d, map[string]string{"health_method": "Health"})
+	for _, expected := range []string{
+		"enum TwirpHealthStatus { serving, notServing, unknown }",
+		"TwirpHealthStatus parseTwirpHealthStatus(String status) {",
+		"extension HaberdasherHealth on Haberdasher {",
+		"Future<TwirpHealthStatus> checkHealth() async {\n    final response = await health(HealthRequest());\n    return parseTwirpHealthStatus(response.status.name);\n  }",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+
+	out = generateClient(t, d, map[string]string{"health_method": "Health", "error_style": "result"})
+	expected := "final response = (await health(HealthRequest())).fold((value) => value, (error) => throw error);"
+	if !strings.Contains(out, expected) {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+	}
+
+	// an output without a status field is serving when the call succeeds
+	d.MessageType[3].Field = nil
+	out = generateClient(t, d, map[string]string{"health_method": "Health"})
+	if !strings.Contains(out, "final response = await health(HealthRequest());\n    return TwirpHealthStatus.serving;") {
+		t.Errorf("expected a status-less health check, got:\n%s", out)
+	}
+
+	// the wrapper is skipped when no method has the name
+	for _, params := range []map[string]string{nil, {"health_method": "Status"}} {
+		out = generateClient(t, d, params)
+		if strings.Contains(out, "TwirpHealthStatus") {
+			t.Errorf("expected no health wrapper with %v, got:\n%s", params, out)
+		}
+	}
+}
+
+func TestCreateClientAPI_RPCPathSegment(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), map[string]string{"rpc_path_segment": "rpc"})
+	for _, expected := range []string{
+		`final _pathPrefix = "/rpc/example.Haberdasher/";`,
+		`'makeHat': '/rpc/example.Haberdasher/MakeHat',`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "/twirp/example.Haberdasher/") {
+		t.Errorf("expected the custom segment to replace twirp, got:\n%s", out)
+	}
+
+	out = generateClient(t, haberdasherFile(), nil)
+	if !strings.Contains(out, `final _pathPrefix = "/twirp/example.Haberdasher/";`) {
+		t.Errorf("expected the twirp segment by default, got:\n%s", out)
+	}
+}
+
+func TestCreateClientAPI_Rename(t *testing.T) {
+	d := haberdasherFile()
+	d.MessageType[1].Field = append(d.MessageType[1].Field, messageField("made_at", 3, ".google.protobuf.Timestamp"))
+
+	out := generateClient(t, d, map[string]string{"pure": "true", "rename": "made_at:createdAt,Hat.color:hue"})
+	for _, expected := range []string{
+		"class Hat {\n  String hue = '';\n  List<String> tags = [];\n  DateTime? createdAt;\n",
+		"if (m.createdAt != null) 'made_at': m.createdAt!.toUtc().toIso8601String(),",
+		"'color': m.hue,",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "madeAt") {
+		t.Errorf("expected made_at to be renamed, got:\n%s", out)
+	}
+}
+
+func TestCreateClientAPI_Reflection(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if strings.Contains(out, "fetchServiceDescriptor") {
+		t.Errorf("expected no descriptor fetch without reflection")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"reflection": "true"})
+	for _, expected := range []string{
+		"import 'dart:typed_data';",
+		"Future<Uint8List> fetchServiceDescriptor({bool refresh = false}) async {",
+		`final response = await client.post(Uri.parse("${hostname}${_pathPrefix}_descriptor"), headers: {`,
+		"throw twirpException(response, method: 'example.Haberdasher/_descriptor');",
+		"return _serviceDescriptor = response.bodyBytes;",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if got := strings.Count(out, "fetchServiceDescriptor("); got != 1 {
+		t.Errorf("expected the clients to share fetchServiceDescriptor, got %d", got)
+	}
+}
+
+func TestCreateClientAPI_MessagesOnly(t *testing.T) {
+	d := haberdasherFile()
+	d.Service = nil
+
+	out := generateClient(t, d, nil)
+	if !strings.Contains(out, "extension HatDebug on Hat {") {
+		t.Errorf("expected the model helpers of a file without services, got:\n%s", out)
+	}
+	for _, unexpected := range []string{
+		"import 'dart:async';",
+		"import 'dart:convert';",
+		"import 'package:http/http.dart';",
+		"class TwirpException",
+		"twirpCodeToHttpStatus",
+		"class TwirpHeaders",
+		"enum TwirpFormat",
+		"normalizeTwirpHostname",
+	} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("expected no %q in a file without services, got:\n%s", unexpected, out)
+		}
+	}
+
+	files := generateFiles(t, d, map[string]string{"split_interfaces": "true"})
+	if len(files) != 1 {
+		t.Errorf("expected no client file without services, got %d files", len(files))
+	}
+
+	// TypedException extends the Twirp exceptions
+	d.MessageType = append(d.MessageType, &descriptor.DescriptorProto{Name: proto.String("ErrorDetails")})
+	out = generateClient(t, d, map[string]string{"meta_type": "example.ErrorDetails"})
+	for _, expected := range []string{"class TwirpJsonException extends TwirpException {", "class TypedException extends TwirpJsonException {"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "enum TwirpFormat") {
+		t.Errorf("expected no client code in a file without services")
+	}
+}
+
+func TestCreateClientAPI_Batch(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+	if strings.Contains(out, "makeHatBatch") {
+		t.Errorf("expected no batch methods without batch")
+	}
+
+	out = generateClient(t, haberdasherFile(), map[string]string{"batch": "true"})
+	for _, expected := range []string{
+		"Future<List<Hat>> makeHatBatch(List<Size> requests) async {",
+		`var uri = Uri.parse("${hostname}${_pathPrefix}MakeHat/batch");`,
+		"final body = encodeJson([for (final request in requests) request.toProto3Json(typeRegistry: typeRegistry)]);",
+		"for (final item in codec.decode(response.body) as List)\n          Hat()..mergeFromProto3Json(item, typeRegistry: typeRegistry),\n    ];\n    return tmp;",
+		"throw twirpException(response, method: 'example.Haberdasher/MakeHat/batch');",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+	if got := strings.Count(out, "makeHatBatch("); got != 1 {
+		t.Errorf("expected only the JSON client to have makeHatBatch, got %d", got)
+	}
+
+	// batches return results like the other methods and keep their timeout
+	d := haberdasherFile()
+	d.Service[0].Method[0].Options = &descriptor.MethodOptions{}
+	if err := proto.SetExtension(d.Service[0].Method[0].Options, E_TimeoutMs, proto.Uint32(5000)); err != nil {
+		t.Fatalf("SetExtension: %v", err)
+	}
+	out = generateClient(t, d, map[string]string{"batch": "true", "error_style": "result"})
+	for _, expected := range []string{
+		"Future<Result<List<Hat>, TwirpException>> makeHatBatch(List<Size> requests, {Duration? timeout}) async {\n    try {\n      return Result.ok(await _makeHatBatch(requests, timeout: timeout));",
+		"Future<List<Hat>> _makeHatBatch(List<Size> requests, {Duration? timeout}) async {",
+		").timeout(timeout ?? const Duration(milliseconds: 5000));\n      } on ClientException catch (e) {",
+		"} on TimeoutException catch (e) {\n        // the timeout bounds every attempt, timed out requests are not retried\n        throw TwirpNetworkException(e, method: 'example.Haberdasher/MakeHat/batch');",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestCreateClientAPI_FileHeader(t *testing.T) {
+	d := haberdasherFile()
+	files := generateFiles(t, d, map[string]string{"split_interfaces": "true"})
+
+	hash := regexp.MustCompile(`^// Code generated by protoc-gen-twirp_dart ` + regexp.QuoteMeta(Version) + `\. DO NOT EDIT\.\n// source: haberdasher\.proto\n// descriptor sha256: ([0-9a-f]{64})\n`)
+	var sums []string
+	for name, content := range files {
+		m := hash.FindStringSubmatch(content)
+		if m == nil {
+			t.Errorf("expected %s to start with the generation header, got:\n%s", name, content[:200])
+			continue
+		}
+		sums = append(sums, m[1])
+	}
+	if len(sums) == 2 && sums[0] != sums[1] {
+		t.Errorf("expected every file of a proto to have the same descriptor hash")
+	}
+
+	before := generateClient(t, d, nil)
+	d.MessageType[0].Field[0].Name = proto.String("centimeters")
+	if after := generateClient(t, d, nil); hash.FindStringSubmatch(after)[1] == hash.FindStringSubmatch(before)[1] {
+		t.Errorf("expected the hash to change with the descriptor")
+	}
+}
+
+func TestCreateClientAPI_ClientPrefixes(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), map[string]string{
+		"json_client_prefix":  "HttpJson",
+		"proto_client_prefix": "HttpProto",
+	})
+
+	for _, expected := range []string{
+		"class HttpJsonHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {",
+		"  HttpJsonHaberdasher(String hostname, {",
+		"class HttpProtoHaberdasher extends _TwirpHaberdasherBase implements Haberdasher {",
+		"  HttpProtoHaberdasher(String hostname, {",
+		"return HttpJsonHaberdasher(hostname, client: client);",
+		"return HttpProtoHaberdasher(hostname, client: client);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "TwirpJsonHaberdasher") || strings.Contains(out, "TwirpProtobufHaberdasher") {
+		t.Errorf("expected the default prefixes to be replaced")
+	}
+}
+
+func TestCreateClientAPI_ExceptionMethod(t *testing.T) {
+	out := generateClient(t, haberdasherFile(), nil)
+
+	for _, expected := range []string{
+		"final String? method;",
+		"TwirpException(this.message, {this.method});",
+		"Exception twirpException(Response response, {String? method}) {",
+		"error = TwirpJsonException.fromJson(jsonDecode(response.body), method: method);",
+		"return error ?? TwirpException(response.body, method: method);",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	// both clients name the rpc at every throw site
+	if got := strings.Count(out, "throw twirpException(response, method: 'example.Haberdasher/MakeHat');"); got != 2 {
+		t.Errorf("expected both clients to pass the rpc to twirpException, got %d", got)
+	}
+	if got := strings.Count(out, "throw TwirpNetworkException(e, method: 'example.Haberdasher/MakeHat');"); got != 2 {
+		t.Errorf("expected both clients to pass the rpc to TwirpNetworkException, got %d", got)
+	}
+	if !strings.Contains(out, "throw twirpException(response, method: 'example.Haberdasher/$method');") {
+		t.Errorf("expected invoke to pass the called rpc")
+	}
+}
+
+func TestCreateClientAPI_HighFieldNumbers(t *testing.T) {
+	last := scalarField("last_field", 536870911, descriptor.FieldDescriptorProto_TYPE_STRING)
+	last.JsonName = proto.String("lastField")
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("ranges.proto"),
+		Package: proto.String("ranges"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Sparse"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("first", 1, descriptor.FieldDescriptorProto_TYPE_INT32),
+					last,
+				},
+				ReservedRange: []*descriptor.DescriptorProto_ReservedRange{
+					{Start: proto.Int32(2), End: proto.Int32(19000)},
+					{Start: proto.Int32(20000), End: proto.Int32(536870911)},
+				},
+				ReservedName: []string{"old_field"},
+			},
+		},
+	}
+
+	out := generateClient(t, d, nil)
+	if !strings.Contains(out, "String lastField = '',") {
+		t.Errorf("expected the field with the highest number to be generated")
+	}
+
+	// the hand-written JSON path keys off the JSON name, never the number
+	field := mustNewField(t, last, d.MessageType[0], d, nil, Options{})
+	if got := parse(field); got != "m['lastField'] as String" {
+		t.Errorf("unexpected parse: %q", got)
+	}
+	if got := stringify(field); got != "m.lastField" {
+		t.Errorf("unexpected stringify: %q", got)
+	}
+}
+
+func TestCreateClientAPI_SealedOneofs(t *testing.T) {
+	oneofField := func(f *descriptor.FieldDescriptorProto) *descriptor.FieldDescriptorProto {
+		f.OneofIndex = proto.Int32(0)
+		return f
+	}
+	d := &descriptor.FileDescriptorProto{
+		Name:    proto.String("shapes.proto"),
+		Package: proto.String("shapes"),
+		MessageType: []*descriptor.DescriptorProto{
+			{Name: proto.String("Square")},
+			{
+				Name: proto.String("Hat"),
+				Field: []*descriptor.FieldDescriptorProto{
+					scalarField("name", 1, descriptor.FieldDescriptorProto_TYPE_STRING),
+					oneofField(scalarField("radius", 2, descriptor.FieldDescriptorProto_TYPE_DOUBLE)),
+					oneofField(messageField("square", 3, ".shapes.Square")),
+					oneofField(scalarField("custom_shape", 4, descriptor.FieldDescriptorProto_TYPE_STRING)),
+					oneofField(scalarField("serial", 5, descriptor.FieldDescriptorProto_TYPE_INT64)),
+					oneofField(messageField("retired_at", 6, ".google.protobuf.Timestamp")),
+				},
+				OneofDecl: []*descriptor.OneofDescriptorProto{
+					{Name: proto.String("shape")},
+				},
+			},
+		},
+	}
+
+	if out := generateClient(t, d, nil); strings.Contains(out, "sealed class") {
+		t.Errorf("expected no sealed classes with the default oneof_style")
+	}
+
+	out := generateClient(t, d, map[string]string{"oneof_style": "sealed"})
+	for _, expected := range []string{
+		"sealed class HatShape {\n  const HatShape();\n}",
+		"final class HatShapeNotSet extends HatShape {",
+		"final class HatShapeRadius extends HatShape {\n  final double radius;\n\n  const HatShapeRadius(this.radius);\n}",
+		"final class HatShapeSquare extends HatShape {\n  final Square square;",
+		"final class HatShapeCustomShape extends HatShape {\n  final String customShape;",
+		"extension HatShapeOneof on Hat {",
+		"switch (whichShape()) {",
+		"case Hat_Shape.customShape:\n        return HatShapeCustomShape(customShape);",
+		"case Hat_Shape.notSet:\n        return const HatShapeNotSet();",
+		"case HatShapeSquare(:final square):\n        this.square = square;",
+		"case Hat_Shape.serial:\n        return HatShapeSerial(serial.toInt());",
+		"case HatShapeSerial(:final serial):\n        this.serial = Int64(serial);",
+		"case Hat_Shape.retiredAt:\n        return HatShapeRetiredAt(retiredAt.toDateTime());",
+		"case HatShapeRetiredAt(:final retiredAt):\n        this.retiredAt = Timestamp.fromDateTime(retiredAt);",
+		"case HatShapeNotSet():\n        clearShape();",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q", expected)
+		}
+	}
+	if strings.Contains(out, "HatShapeName") {
+		t.Errorf("expected fields outside the oneof to have no case class")
+	}
+}
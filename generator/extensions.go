@@ -0,0 +1,108 @@
+package generator
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// E_ListOutput is the (twirp_dart.list_output) method option declared in
+// twirp_dart/options.proto.
+var E_ListOutput = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.MethodOptions)(nil),
+	ExtensionType: (*bool)(nil),
+	Field:         51234,
+	Name:          "twirp_dart.list_output",
+	Tag:           "varint,51234,opt,name=list_output",
+	Filename:      "twirp_dart/options.proto",
+}
+
+// E_Encoding is the (twirp_dart.encoding) method option declared in
+// twirp_dart/options.proto.
+var E_Encoding = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.MethodOptions)(nil),
+	ExtensionType: (*string)(nil),
+	Field:         51235,
+	Name:          "twirp_dart.encoding",
+	Tag:           "bytes,51235,opt,name=encoding",
+	Filename:      "twirp_dart/options.proto",
+}
+
+// E_TimeoutMs is the (twirp_dart.timeout_ms) method option declared in
+// twirp_dart/options.proto.
+var E_TimeoutMs = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.MethodOptions)(nil),
+	ExtensionType: (*uint32)(nil),
+	Field:         51236,
+	Name:          "twirp_dart.timeout_ms",
+	Tag:           "varint,51236,opt,name=timeout_ms",
+	Filename:      "twirp_dart/options.proto",
+}
+
+// E_GetSafe is the (twirp_dart.get_safe) method option declared in
+// twirp_dart/options.proto.
+var E_GetSafe = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.MethodOptions)(nil),
+	ExtensionType: (*bool)(nil),
+	Field:         51237,
+	Name:          "twirp_dart.get_safe",
+	Tag:           "varint,51237,opt,name=get_safe",
+	Filename:      "twirp_dart/options.proto",
+}
+
+func init() {
+	proto.RegisterExtension(E_ListOutput)
+	proto.RegisterExtension(E_Encoding)
+	proto.RegisterExtension(E_TimeoutMs)
+	proto.RegisterExtension(E_GetSafe)
+}
+
+// boolMethodOption returns the value of a bool method option, false when it
+// is not set.
+func boolMethodOption(m *descriptor.MethodDescriptorProto, ext *proto.ExtensionDesc) bool {
+	if m.GetOptions() == nil || !proto.HasExtension(m.GetOptions(), ext) {
+		return false
+	}
+
+	v, err := proto.GetExtension(m.GetOptions(), ext)
+	if err != nil {
+		return false
+	}
+	b, ok := v.(*bool)
+	return ok && *b
+}
+
+// stringMethodOption returns the value of a string method option, empty when
+// it is not set.
+func stringMethodOption(m *descriptor.MethodDescriptorProto, ext *proto.ExtensionDesc) string {
+	if m.GetOptions() == nil || !proto.HasExtension(m.GetOptions(), ext) {
+		return ""
+	}
+
+	v, err := proto.GetExtension(m.GetOptions(), ext)
+	if err != nil {
+		return ""
+	}
+	s, ok := v.(*string)
+	if !ok {
+		return ""
+	}
+	return *s
+}
+
+// uint32MethodOption returns the value of a uint32 method option, 0 when it
+// is not set.
+func uint32MethodOption(m *descriptor.MethodDescriptorProto, ext *proto.ExtensionDesc) uint32 {
+	if m.GetOptions() == nil || !proto.HasExtension(m.GetOptions(), ext) {
+		return 0
+	}
+
+	v, err := proto.GetExtension(m.GetOptions(), ext)
+	if err != nil {
+		return 0
+	}
+	n, ok := v.(*uint32)
+	if !ok {
+		return 0
+	}
+	return *n
+}
@@ -3,12 +3,85 @@ package generator
 import (
 	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
 	"path"
+	"regexp"
+	"strings"
+	"unicode"
 )
 
+// wellKnownFiles are the google/protobuf files whose types get special
+// handling. No client is generated for them and they are never imported.
+var wellKnownFiles = map[string]bool{
+	"google/protobuf/any.proto":        true,
+	"google/protobuf/field_mask.proto": true,
+	"google/protobuf/struct.proto":     true,
+	"google/protobuf/timestamp.proto":  true,
+}
+
+// IsWellKnownFile reports whether the proto file holds well known types that
+// the generator handles itself.
+func IsWellKnownFile(name string) bool {
+	return wellKnownFiles[name]
+}
+
 func dartModuleFilename(f *descriptor.FileDescriptorProto) string {
 	return twirpFilename(*f.Name)
 }
 
+// dartClientFilename is the file holding the client implementations when
+// interfaces are generated into their own file.
+func dartClientFilename(f *descriptor.FileDescriptorProto) string {
+	return strings.TrimSuffix(twirpFilename(*f.Name), ".twirp.dart") + ".client.twirp.dart"
+}
+
+// dartModelsFilename is the part file holding the model helpers when the
+// part_files option is set.
+func dartModelsFilename(f *descriptor.FileDescriptorProto) string {
+	return strings.TrimSuffix(twirpFilename(*f.Name), ".twirp.dart") + ".models.twirp.dart"
+}
+
+// dartDeprecatedFilename is the file listing the deprecated methods of s
+// with the deprecated_file option, e.g. haberdasher_admin.deprecated.dart.
+func dartDeprecatedFilename(s *Service) string {
+	return snakeCase(s.Name) + ".deprecated.dart"
+}
+
+// snakeCase turns a CamelCase name into lower snake_case.
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 && !unicode.IsUpper(rune(name[i-1])) && name[i-1] != '_' {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// dartLibraryName is the library name of the generated file, the proto path
+// with every segment made a Dart identifier, e.g. example.service.twirp.
+func dartLibraryName(f *descriptor.FileDescriptorProto) string {
+	name := strings.TrimSuffix(f.GetName(), path.Ext(f.GetName()))
+
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		segment = nonIdentifierChars.ReplaceAllString(strings.ToLower(segment), "_")
+		if segment == "" {
+			continue
+		}
+		if segment[0] >= '0' && segment[0] <= '9' {
+			segment = "_" + segment
+		}
+		segments = append(segments, segment)
+	}
+
+	return strings.Join(append(segments, "twirp"), ".")
+}
+
+var nonIdentifierChars = regexp.MustCompile(`[^a-z0-9_]`)
+
 func dartFilename(name string) string {
 	if ext := path.Ext(name); ext == ".proto" || ext == ".protodevel" {
 		base := path.Base(name)
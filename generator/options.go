@@ -0,0 +1,429 @@
+package generator
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Options controls how the client code is generated. The values come from the
+// key/value parameters passed to the plugin by protoc.
+type Options struct {
+	// UseProtoNames uses the original proto field names as JSON keys instead
+	// of the lowerCamelCase (or json_name) keys of the proto3 JSON mapping.
+	// Only pure models write their own JSON, protoc-gen-dart messages always
+	// use the json_name.
+	UseProtoNames bool
+
+	// ImportPrefix turns the relative imports of generated and protoc-gen-dart
+	// files into package imports, e.g. package:my_pkg.
+	ImportPrefix string
+
+	// JSONContentType and ProtoContentType are the Content-Type headers sent
+	// by the JSON and protobuf clients.
+	JSONContentType  string
+	ProtoContentType string
+
+	// MethodPath selects how rpc names appear in request paths: "raw" keeps
+	// the proto method name verbatim, "camel" CamelCases it like protoc-gen-go.
+	MethodPath string
+
+	// GenerateBuilders emits a fluent <Model>Builder for every rpc input message.
+	GenerateBuilders bool
+
+	// GetRequests makes the JSON client call rpcs marked
+	// idempotency_level = NO_SIDE_EFFECTS with the Twirp v5 GET protocol.
+	GetRequests bool
+
+	// SplitInterfaces generates the service interfaces, models and exceptions
+	// into <name>.twirp.dart without importing package:http, and the client
+	// implementations into <name>.client.twirp.dart.
+	SplitInterfaces bool
+
+	// DefaultHostname is baked into the clients as the default of an optional
+	// hostname parameter, so call sites of fixed deployments can omit it.
+	DefaultHostname string
+
+	// TypePrefix is prepended to the Dart names of the messages, enums and
+	// services. The protoc-gen-dart classes are aliased with typedefs.
+	TypePrefix string
+
+	// ResponseHeaders adds a <method>WithHeaders variant of every method,
+	// returning the response headers along with the output message.
+	ResponseHeaders bool
+
+	// ContentTypeDispatch decodes responses by their Content-Type header
+	// instead of assuming the format of the client.
+	ContentTypeDispatch bool
+
+	// PartFiles moves the model helpers into <name>.models.twirp.dart, a
+	// part of the library in <name>.twirp.dart.
+	PartFiles bool
+
+	// JSONClientPrefix and ProtoClientPrefix are prepended to the service
+	// name to name the JSON and protobuf client classes.
+	JSONClientPrefix  string
+	ProtoClientPrefix string
+
+	// OneofStyle selects what is generated for oneofs: "flat" relies on the
+	// fields and which<Oneof>() of the protoc-gen-dart classes, "sealed" adds
+	// a Dart 3 sealed class per oneof with a subclass per case.
+	OneofStyle string
+
+	// ErrorStyle selects how the clients report failures: "throw" throws a
+	// TwirpException, "result" returns a Result holding the output or the error
+	// and "sealed" a sealed TwirpResult, Ok or Err.
+	ErrorStyle string
+
+	// ValidateRequired generates a validate() method for rpc input messages
+	// with proto2 required fields, called by the clients before sending.
+	ValidateRequired bool
+
+	// DeprecatedFile emits a <service>.deprecated.dart file per service
+	// listing the methods marked with option deprecated = true.
+	DeprecatedFile bool
+
+	// Clients selects the client classes to generate: "both", "json" or
+	// "protobuf".
+	Clients string
+
+	// MetaType is the fully qualified name of a message, e.g.
+	// example.ErrorDetails, the file defining it generates a TypedException
+	// decoding the meta of Twirp errors into it.
+	MetaType string
+
+	// ErrorEnum is the fully qualified name of a top-level enum of domain
+	// errors, e.g. example.HatError, the file defining it generates an
+	// exception parsing the enum value of Twirp errors.
+	ErrorEnum string
+
+	// Pure generates self-contained files defining plain Dart model classes
+	// instead of importing the protoc-gen-dart files. Pure files only have
+	// the JSON clients.
+	Pure bool
+
+	// LastRequestID adds a lastRequestId field to the clients, set from the
+	// request-id header of every response.
+	LastRequestID bool
+
+	// UseFreezed generates an immutable @freezed copy of every model, e.g.
+	// HatData for Hat, with conversions in both directions.
+	UseFreezed bool
+
+	// PositionalArgs generates <method>With extension methods taking the
+	// fields of scalar-only requests as positional arguments.
+	PositionalArgs bool
+
+	// IndentSpaces indents the generated files with this many spaces per
+	// level, 2 like dart format by default, see formatDart. Zero keeps the
+	// tabs of the templates.
+	IndentSpaces int
+
+	// DocumentErrors documents the exceptions of the methods of the service
+	// interfaces.
+	DocumentErrors bool
+
+	// HealthMethod names an rpc, e.g. Health, wrapped by a checkHealth
+	// extension method returning a TwirpHealthStatus.
+	HealthMethod string
+
+	// RPCPathSegment is the segment the Twirp routes are mounted on,
+	// "twirp" in /twirp/example.Haberdasher/MakeHat.
+	RPCPathSegment string
+
+	// Rename overrides the Dart names of fields of the pure models, keyed
+	// by the proto field name, e.g. hat_color, or the message qualified
+	// name, e.g. Hat.color. The JSON names are kept.
+	Rename map[string]string
+
+	// Reflection adds a fetchServiceDescriptor method to the clients,
+	// fetching the descriptor of the service from the server.
+	Reflection bool
+
+	// Batch adds a <method>Batch method to the JSON clients, posting a list
+	// of requests to the batch endpoint of a gateway.
+	Batch bool
+}
+
+// NewOptions builds the generator Options from the plugin parameters.
+// Unknown parameters are ignored so other tooling can share the parameter string.
+func NewOptions(params map[string]string) (Options, error) {
+	opts := Options{
+		JSONContentType:   "application/json",
+		ProtoContentType:  "application/protobuf",
+		JSONClientPrefix:  "TwirpJson",
+		ProtoClientPrefix: "TwirpProtobuf",
+		IndentSpaces:      2,
+	}
+
+	var err error
+	if opts.UseProtoNames, err = boolParam(params, "use_proto_names"); err != nil {
+		return opts, err
+	}
+
+	if opts.GenerateBuilders, err = boolParam(params, "generate_builders"); err != nil {
+		return opts, err
+	}
+
+	if opts.GetRequests, err = boolParam(params, "get_requests"); err != nil {
+		return opts, err
+	}
+
+	if opts.SplitInterfaces, err = boolParam(params, "split_interfaces"); err != nil {
+		return opts, err
+	}
+
+	if opts.ResponseHeaders, err = boolParam(params, "response_headers"); err != nil {
+		return opts, err
+	}
+
+	if opts.ContentTypeDispatch, err = boolParam(params, "content_type_dispatch"); err != nil {
+		return opts, err
+	}
+
+	if opts.PartFiles, err = boolParam(params, "part_files"); err != nil {
+		return opts, err
+	}
+
+	if opts.ValidateRequired, err = boolParam(params, "validate_required"); err != nil {
+		return opts, err
+	}
+
+	if opts.DeprecatedFile, err = boolParam(params, "deprecated_file"); err != nil {
+		return opts, err
+	}
+
+	if opts.LastRequestID, err = boolParam(params, "last_request_id"); err != nil {
+		return opts, err
+	}
+
+	if v := params["indent"]; v == "tab" {
+		opts.IndentSpaces = 0
+	} else if v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 8 {
+			return opts, fmt.Errorf("invalid value %q for parameter indent: expected tab or a number of spaces from 1 to 8", v)
+		}
+		opts.IndentSpaces = n
+	}
+
+	opts.ImportPrefix = params["import_prefix"]
+	opts.JSONContentType = stringParam(params, "json_content_type", opts.JSONContentType)
+	opts.ProtoContentType = stringParam(params, "proto_content_type", opts.ProtoContentType)
+
+	if opts.MethodPath, err = choiceParam(params, "method_path", "raw", "camel"); err != nil {
+		return opts, err
+	}
+
+	if opts.OneofStyle, err = choiceParam(params, "oneof_style", "flat", "sealed"); err != nil {
+		return opts, err
+	}
+
+	if opts.ErrorStyle, err = choiceParam(params, "error_style", "throw", "result", "sealed"); err != nil {
+		return opts, err
+	}
+	if opts.ReturnsResult() && opts.ResponseHeaders {
+		return opts, fmt.Errorf("error_style=%s can't be combined with response_headers", opts.ErrorStyle)
+	}
+
+	if opts.Clients, err = choiceParam(params, "clients", "both", "json", "protobuf"); err != nil {
+		return opts, err
+	}
+
+	if opts.UseFreezed, err = boolParam(params, "use_freezed"); err != nil {
+		return opts, err
+	}
+
+	if opts.PositionalArgs, err = boolParam(params, "positional_args"); err != nil {
+		return opts, err
+	}
+
+	if opts.DocumentErrors, err = boolParam(params, "document_errors"); err != nil {
+		return opts, err
+	}
+
+	if opts.Reflection, err = boolParam(params, "reflection"); err != nil {
+		return opts, err
+	}
+
+	if opts.Batch, err = boolParam(params, "batch"); err != nil {
+		return opts, err
+	}
+
+	opts.HealthMethod = params["health_method"]
+
+	opts.RPCPathSegment = stringParam(params, "rpc_path_segment", "twirp")
+	if !pathSegment.MatchString(opts.RPCPathSegment) {
+		return opts, fmt.Errorf("invalid value %q for parameter rpc_path_segment: expected a path segment of letters, digits and -._~", opts.RPCPathSegment)
+	}
+
+	if opts.Pure, err = boolParam(params, "pure"); err != nil {
+		return opts, err
+	}
+	if opts.Pure {
+		if err := checkPureOptions(params, opts); err != nil {
+			return opts, err
+		}
+		opts.Clients = "json"
+	}
+	if opts.UseProtoNames && !opts.Pure {
+		return opts, fmt.Errorf("use_proto_names needs pure=true, the protoc-gen-dart classes always encode the lowerCamelCase json_name")
+	}
+
+	if opts.Rename, err = renameParam(params, "rename"); err != nil {
+		return opts, err
+	}
+	if len(opts.Rename) > 0 && !opts.Pure {
+		return opts, fmt.Errorf("rename needs pure=true, the protoc-gen-dart classes name their own fields")
+	}
+
+	if opts.DefaultHostname, err = hostnameParam(params, "default_hostname"); err != nil {
+		return opts, err
+	}
+
+	opts.MetaType = strings.TrimPrefix(params["meta_type"], ".")
+	opts.ErrorEnum = strings.TrimPrefix(params["error_enum"], ".")
+
+	opts.TypePrefix = params["type_prefix"]
+	if opts.TypePrefix != "" && !dartIdentifier.MatchString(opts.TypePrefix) {
+		return opts, fmt.Errorf("invalid value %q for parameter type_prefix: expected a Dart identifier", opts.TypePrefix)
+	}
+
+	opts.JSONClientPrefix = stringParam(params, "json_client_prefix", opts.JSONClientPrefix)
+	opts.ProtoClientPrefix = stringParam(params, "proto_client_prefix", opts.ProtoClientPrefix)
+	for key, prefix := range map[string]string{"json_client_prefix": opts.JSONClientPrefix, "proto_client_prefix": opts.ProtoClientPrefix} {
+		if !dartIdentifier.MatchString(prefix) {
+			return opts, fmt.Errorf("invalid value %q for parameter %s: expected a Dart identifier", prefix, key)
+		}
+	}
+	if opts.JSONClientPrefix == opts.ProtoClientPrefix {
+		return opts, fmt.Errorf("json_client_prefix and proto_client_prefix must differ, both are %q", opts.JSONClientPrefix)
+	}
+
+	return opts, nil
+}
+
+// JSONClient reports whether the JSON client classes are generated.
+func (o Options) JSONClient() bool {
+	return o.Clients != "protobuf"
+}
+
+// ProtoClient reports whether the protobuf client classes are generated.
+func (o Options) ProtoClient() bool {
+	return o.Clients != "json"
+}
+
+// ReturnsResult reports whether the methods return their errors instead of
+// throwing them.
+func (o Options) ReturnsResult() bool {
+	return o.ErrorStyle == "result" || o.ErrorStyle == "sealed"
+}
+
+// ResultType is the Dart type of the results of a method returning out with
+// the error_style.
+func (o Options) ResultType(out string) string {
+	if o.ErrorStyle == "sealed" {
+		return "TwirpResult<" + out + ">"
+	}
+	return "Result<" + out + ", TwirpException>"
+}
+
+// checkPureOptions rejects the options relying on the protoc-gen-dart classes
+// or the protobuf encoding, which pure files don't have.
+func checkPureOptions(params map[string]string, opts Options) error {
+	switch {
+	case params["clients"] != "" && opts.Clients != "json":
+		return fmt.Errorf("pure files only have JSON clients, clients=%s is not supported", opts.Clients)
+	case opts.ContentTypeDispatch:
+		return fmt.Errorf("pure files can't decode protobuf responses, content_type_dispatch is not supported")
+	case opts.OneofStyle == "sealed":
+		return fmt.Errorf("pure files don't track oneof cases, oneof_style=sealed is not supported")
+	case opts.ValidateRequired:
+		return fmt.Errorf("pure files don't track field presence, validate_required is not supported")
+	case opts.UseFreezed:
+		return fmt.Errorf("pure files define plain model classes, use_freezed is not supported")
+	}
+	return nil
+}
+
+var dartIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pathSegment matches a URL path segment that needs no escaping.
+var pathSegment = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// hostnameParam returns the value of key, which must be an absolute http or
+// https URL when set. It is emitted in a Dart string literal, so quotes,
+// backslashes and interpolation are rejected too.
+func hostnameParam(params map[string]string, key string) (string, error) {
+	v := params[key]
+	if v == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(v, "'\\$") {
+		return "", fmt.Errorf("invalid value %q for parameter %s: expected an absolute http or https URL", v, key)
+	}
+
+	return strings.TrimRight(v, "/"), nil
+}
+
+func stringParam(params map[string]string, key, def string) string {
+	if v := params[key]; v != "" {
+		return v
+	}
+
+	return def
+}
+
+// renameParam parses key as comma separated old:new pairs, mapping proto
+// field names to Dart identifiers.
+func renameParam(params map[string]string, key string) (map[string]string, error) {
+	v := params[key]
+	if v == "" {
+		return nil, nil
+	}
+
+	rename := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || !dartIdentifier.MatchString(kv[1]) {
+			return nil, fmt.Errorf("invalid value %q for parameter %s: expected old:new pairs with Dart identifiers as new names", pair, key)
+		}
+		rename[kv[0]] = kv[1]
+	}
+	return rename, nil
+}
+
+// choiceParam returns the value of key, which must be one of choices. The
+// first choice is the default.
+func choiceParam(params map[string]string, key string, choices ...string) (string, error) {
+	v, ok := params[key]
+	if !ok || v == "" {
+		return choices[0], nil
+	}
+
+	for _, c := range choices {
+		if v == c {
+			return v, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid value %q for parameter %s: expected one of %s", v, key, strings.Join(choices, ", "))
+}
+
+func boolParam(params map[string]string, key string) (bool, error) {
+	v, ok := params[key]
+	if !ok {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for parameter %s: expected true or false", v, key)
+	}
+
+	return b, nil
+}
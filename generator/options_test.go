@@ -0,0 +1,209 @@
+package generator
+
+import "testing"
+
+func TestNewOptions(t *testing.T) {
+	opts, err := NewOptions(map[string]string{
+		"pure":            "true",
+		"use_proto_names": "true",
+		"package_name":    "ignored",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !opts.UseProtoNames {
+		t.Errorf("expected UseProtoNames to be true")
+	}
+
+	if _, err := NewOptions(map[string]string{"use_proto_names": "yes please"}); err == nil {
+		t.Errorf("expected an error for an invalid boolean parameter")
+	}
+	if _, err := NewOptions(map[string]string{"use_proto_names": "true"}); err == nil {
+		t.Errorf("expected an error for use_proto_names without pure")
+	}
+}
+
+func TestNewOptions_ImportPrefix(t *testing.T) {
+	opts, err := NewOptions(map[string]string{"import_prefix": "package:my_pkg"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.ImportPrefix != "package:my_pkg" {
+		t.Errorf("expected ImportPrefix package:my_pkg, got %q", opts.ImportPrefix)
+	}
+}
+
+func TestNewOptions_Choice(t *testing.T) {
+	opts, err := NewOptions(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.MethodPath != "raw" {
+		t.Errorf("expected method_path to default to raw, got %q", opts.MethodPath)
+	}
+
+	if _, err := NewOptions(map[string]string{"method_path": "snake"}); err == nil {
+		t.Errorf("expected an error for an unknown method_path")
+	}
+}
+
+func TestNewOptions_DefaultHostname(t *testing.T) {
+	opts, err := NewOptions(map[string]string{"default_hostname": "https://api.example.com/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.DefaultHostname != "https://api.example.com" {
+		t.Errorf("expected the trailing slash to be stripped, got %q", opts.DefaultHostname)
+	}
+
+	for _, invalid := range []string{"api.example.com", "ftp://api.example.com", "https://api.example.com/$x"} {
+		if _, err := NewOptions(map[string]string{"default_hostname": invalid}); err == nil {
+			t.Errorf("expected an error for default_hostname %q", invalid)
+		}
+	}
+}
+
+func TestNewOptions_Indent(t *testing.T) {
+	for value, expected := range map[string]int{"": 2, "tab": 0, "2": 2, "4": 4} {
+		opts, err := NewOptions(map[string]string{"indent": value})
+		if err != nil {
+			t.Fatalf("unexpected error for indent %q: %v", value, err)
+		}
+		if opts.IndentSpaces != expected {
+			t.Errorf("expected %d spaces for indent %q, got %d", expected, value, opts.IndentSpaces)
+		}
+	}
+
+	for _, invalid := range []string{"0", "9", "spaces"} {
+		if _, err := NewOptions(map[string]string{"indent": invalid}); err == nil {
+			t.Errorf("expected an error for indent %q", invalid)
+		}
+	}
+}
+
+func TestNewOptions_TypePrefix(t *testing.T) {
+	if _, err := NewOptions(map[string]string{"type_prefix": "Ex"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := NewOptions(map[string]string{"type_prefix": "1-x"}); err == nil {
+		t.Errorf("expected an error for a type_prefix that is no Dart identifier")
+	}
+}
+
+func TestNewOptions_RPCPathSegment(t *testing.T) {
+	opts, err := NewOptions(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.RPCPathSegment != "twirp" {
+		t.Errorf("expected the twirp segment by default, got %q", opts.RPCPathSegment)
+	}
+	for _, segment := range []string{"api/twirp", "/twirp", "a b"} {
+		if _, err := NewOptions(map[string]string{"rpc_path_segment": segment}); err == nil {
+			t.Errorf("expected an error for rpc_path_segment=%q", segment)
+		}
+	}
+}
+
+func TestNewOptions_ClientPrefixes(t *testing.T) {
+	opts, err := NewOptions(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.JSONClientPrefix != "TwirpJson" || opts.ProtoClientPrefix != "TwirpProtobuf" {
+		t.Errorf("unexpected default prefixes %q and %q", opts.JSONClientPrefix, opts.ProtoClientPrefix)
+	}
+
+	for _, params := range []map[string]string{
+		{"json_client_prefix": "Http-Json"},
+		{"json_client_prefix": "Api", "proto_client_prefix": "Api"},
+	} {
+		if _, err := NewOptions(params); err == nil {
+			t.Errorf("expected an error for %v", params)
+		}
+	}
+}
+
+func TestNewOptions_OneofStyle(t *testing.T) {
+	opts, err := NewOptions(map[string]string{"oneof_style": "sealed"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.OneofStyle != "sealed" {
+		t.Errorf("expected oneof_style sealed, got %q", opts.OneofStyle)
+	}
+	if _, err := NewOptions(map[string]string{"oneof_style": "union"}); err == nil {
+		t.Errorf("expected an error for an unknown oneof_style")
+	}
+}
+
+func TestNewOptions_ErrorStyle(t *testing.T) {
+	opts, err := NewOptions(map[string]string{"error_style": "result"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.ErrorStyle != "result" {
+		t.Errorf("expected error_style result, got %q", opts.ErrorStyle)
+	}
+	if _, err := NewOptions(map[string]string{"error_style": "result", "response_headers": "true"}); err == nil {
+		t.Errorf("expected an error combining error_style=result with response_headers")
+	}
+	if _, err := NewOptions(map[string]string{"error_style": "sealed", "response_headers": "true"}); err == nil {
+		t.Errorf("expected an error combining error_style=sealed with response_headers")
+	}
+}
+
+func TestNewOptions_Clients(t *testing.T) {
+	for clients, expected := range map[string][2]bool{"": {true, true}, "both": {true, true}, "json": {true, false}, "protobuf": {false, true}} {
+		opts, err := NewOptions(map[string]string{"clients": clients})
+		if err != nil {
+			t.Fatalf("unexpected error for clients=%s: %v", clients, err)
+		}
+		if got := [2]bool{opts.JSONClient(), opts.ProtoClient()}; got != expected {
+			t.Errorf("clients=%s: expected json, protobuf clients %v, got %v", clients, expected, got)
+		}
+	}
+	if _, err := NewOptions(map[string]string{"clients": "grpc"}); err == nil {
+		t.Errorf("expected an error for an unknown clients value")
+	}
+}
+
+func TestNewOptions_Rename(t *testing.T) {
+	opts, err := NewOptions(map[string]string{"pure": "true", "rename": "made_at:createdAt,Hat.color:hue"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.Rename["made_at"] != "createdAt" || opts.Rename["Hat.color"] != "hue" {
+		t.Errorf("unexpected renames %v", opts.Rename)
+	}
+	for _, rename := range []string{"made_at", "made_at:created-at", ":createdAt"} {
+		if _, err := NewOptions(map[string]string{"pure": "true", "rename": rename}); err == nil {
+			t.Errorf("expected an error for rename=%s", rename)
+		}
+	}
+	if _, err := NewOptions(map[string]string{"rename": "made_at:createdAt"}); err == nil {
+		t.Errorf("expected an error for rename without pure")
+	}
+}
+
+func TestNewOptions_Pure(t *testing.T) {
+	opts, err := NewOptions(map[string]string{"pure": "true"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !opts.JSONClient() || opts.ProtoClient() {
+		t.Errorf("expected pure files to only have JSON clients")
+	}
+
+	for _, params := range []map[string]string{
+		{"pure": "true", "clients": "protobuf"},
+		{"pure": "true", "content_type_dispatch": "true"},
+		{"pure": "true", "oneof_style": "sealed"},
+		{"pure": "true", "validate_required": "true"},
+		{"pure": "true", "use_freezed": "true"},
+	} {
+		if _, err := NewOptions(params); err == nil {
+			t.Errorf("expected an error for %v", params)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package generator
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// Registry records which proto file defines each message type across all the
+// files of a single CodeGeneratorRequest, so types shared between files can be
+// resolved and imported.
+type Registry struct {
+	files map[string]string
+	// enums maps the top-level enums to their file the same way.
+	enums map[string]string
+	// classes maps the messages and enums, including nested ones, to the
+	// Dart class protoc-gen-dart generates for them, e.g. Hat_Inner.
+	classes map[string]string
+}
+
+// NewRegistry indexes the messages, including nested ones, of every file.
+func NewRegistry(files []*descriptor.FileDescriptorProto) *Registry {
+	r := &Registry{files: make(map[string]string), enums: make(map[string]string), classes: make(map[string]string)}
+
+	for _, f := range files {
+		prefix := ""
+		if f.GetPackage() != "" {
+			prefix = "." + f.GetPackage()
+		}
+		r.addMessages(f.GetName(), prefix, "", f.GetMessageType())
+		for _, e := range f.GetEnumType() {
+			r.enums[prefix+"."+e.GetName()] = f.GetName()
+			r.classes[prefix+"."+e.GetName()] = e.GetName()
+		}
+	}
+
+	return r
+}
+
+func (r *Registry) addMessages(file, prefix, classPrefix string, messages []*descriptor.DescriptorProto) {
+	for _, m := range messages {
+		name := prefix + "." + m.GetName()
+		class := classPrefix + m.GetName()
+		r.files[name] = file
+		r.classes[name] = class
+		for _, e := range m.GetEnumType() {
+			r.classes[name+"."+e.GetName()] = class + "_" + e.GetName()
+		}
+		r.addMessages(file, name, class+"_", m.GetNestedType())
+	}
+}
+
+// FileOf returns the proto file defining the fully qualified type name,
+// e.g. ".example.Hat".
+func (r *Registry) FileOf(typeName string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+
+	file, ok := r.files[typeName]
+	return file, ok
+}
+
+// EnumFileOf returns the file defining the top-level enum typeName, like
+// FileOf for messages.
+func (r *Registry) EnumFileOf(typeName string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+
+	file, ok := r.enums[typeName]
+	return file, ok
+}
+
+// ClassOf returns the Dart class of the fully qualified message or enum
+// typeName, nested types are joined to their parents with underscores.
+func (r *Registry) ClassOf(typeName string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+
+	class, ok := r.classes[typeName]
+	return class, ok
+}
+
+// relativeImport returns the import path of the file at target as seen from
+// the file at source, both relative to the output directory.
+func relativeImport(source, target string) string {
+	rel, err := filepath.Rel(filepath.Dir(source), target)
+	if err != nil {
+		return target
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// packageImport qualifies a path relative to the output directory with the
+// import_prefix option, e.g. package:my_pkg.
+func packageImport(prefix, target string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + target
+}
+
+func pbFilename(protoFile string) string {
+	return strings.TrimSuffix(protoFile, path.Ext(protoFile)) + ".pb.dart"
+}
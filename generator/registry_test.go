@@ -0,0 +1,71 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+func TestRegistry_FileOf(t *testing.T) {
+	r := NewRegistry([]*descriptor.FileDescriptorProto{
+		{
+			Name:    proto.String("a/outer.proto"),
+			Package: proto.String("a.b"),
+			MessageType: []*descriptor.DescriptorProto{
+				{
+					Name:       proto.String("Outer"),
+					NestedType: []*descriptor.DescriptorProto{{Name: proto.String("Inner")}},
+				},
+			},
+		},
+	})
+
+	for _, name := range []string{".a.b.Outer", ".a.b.Outer.Inner"} {
+		if file, ok := r.FileOf(name); !ok || file != "a/outer.proto" {
+			t.Errorf("expected %s to be defined in a/outer.proto, got %q", name, file)
+		}
+	}
+
+	if _, ok := r.FileOf(".a.b.Missing"); ok {
+		t.Errorf("expected unknown types to be unresolved")
+	}
+
+	var nilRegistry *Registry
+	if _, ok := nilRegistry.FileOf(".a.b.Outer"); ok {
+		t.Errorf("expected a nil registry to resolve nothing")
+	}
+}
+
+func TestRegistry_EnumFileOf(t *testing.T) {
+	r := NewRegistry([]*descriptor.FileDescriptorProto{
+		{
+			Name:     proto.String("a/errors.proto"),
+			Package:  proto.String("a.b"),
+			EnumType: []*descriptor.EnumDescriptorProto{{Name: proto.String("Code")}},
+		},
+	})
+
+	if file, ok := r.EnumFileOf(".a.b.Code"); !ok || file != "a/errors.proto" {
+		t.Errorf("expected .a.b.Code to be defined in a/errors.proto, got %q", file)
+	}
+	if _, ok := r.FileOf(".a.b.Code"); ok {
+		t.Errorf("expected enums not to resolve as messages")
+	}
+}
+
+func TestRelativeImport(t *testing.T) {
+	tests := []struct {
+		source, target, expected string
+	}{
+		{"api/service.proto", "api/common.pb.dart", "common.pb.dart"},
+		{"api/service.proto", "shared/common.pb.dart", "../shared/common.pb.dart"},
+		{"service.proto", "shared/common.pb.dart", "shared/common.pb.dart"},
+	}
+
+	for _, tt := range tests {
+		if got := relativeImport(tt.source, tt.target); got != tt.expected {
+			t.Errorf("relativeImport(%q, %q) = %q, expected %q", tt.source, tt.target, got, tt.expected)
+		}
+	}
+}
@@ -2,9 +2,4 @@ module github.com/unicomp21/protoc-gen-twirp_dart
 
 go 1.17
 
-require (
-	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/twitchtv/twirp v8.1.0+incompatible // indirect
-	google.golang.org/protobuf v1.26.0 // indirect
-)
+require github.com/gogo/protobuf v1.3.2
@@ -8,8 +8,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/gogo/protobuf/proto"
 	gogogen "github.com/gogo/protobuf/protoc-gen-gogo/generator"
-	"github.com/golang/protobuf/proto"
 )
 
 func main() {
@@ -38,23 +38,30 @@ func readRequest(r io.Reader) *plugin_go.CodeGeneratorRequest {
 func generate(in *plugin_go.CodeGeneratorRequest) *plugin_go.CodeGeneratorResponse {
 	resp := &plugin_go.CodeGeneratorResponse{}
 
+	opts, err := generator.NewOptions(getParameters(in))
+	if err != nil {
+		resp.Error = proto.String(err.Error())
+		return resp
+	}
+
 	gen := gogogen.New()
 	gen.Request = in
 	gen.WrapTypes()
 	gen.SetPackageNames()
 	gen.BuildTypeNameMap()
+	registry := generator.NewRegistry(in.GetProtoFile())
 	for _, f := range in.GetProtoFile() {
-		// skip google/protobuf/timestamp, we don't do any special serialization for jsonpb.
-		if *f.Name == "google/protobuf/timestamp.proto" {
+		// skip the well known types, they are handled by the generator.
+		if generator.IsWellKnownFile(*f.Name) {
 			continue
 		}
-		cf, err := generator.CreateClientAPI(f, gen)
+		files, err := generator.CreateClientAPI(f, gen, registry, opts)
 		if err != nil {
 			resp.Error = proto.String(err.Error())
 			return resp
 		}
 
-		resp.File = append(resp.File, cf)
+		resp.File = append(resp.File, files...)
 	}
 
 	//resp.File = append(resp.File, generator.RuntimeLibrary())
@@ -84,8 +91,19 @@ func getParameters(in *plugin_go.CodeGeneratorRequest) Params {
 
 	pairs := strings.Split(*in.Parameter, ",")
 
+	last := ""
 	for _, pair := range pairs {
-		kv := strings.Split(pair, "=")
+		kv := strings.SplitN(pair, "=", 2)
+		// the pairs of list values, e.g. rename=a:b,c:d, are split too
+		if len(kv) == 1 && last != "" && strings.Contains(pair, ":") {
+			params[last] += "," + pair
+			continue
+		}
+		last = kv[0]
+		if len(kv) == 1 {
+			params[kv[0]] = ""
+			continue
+		}
 		params[kv[0]] = kv[1]
 	}
 